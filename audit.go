@@ -0,0 +1,340 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// auditBuffer is the number of records waiting for the write, the records above it are dropped,
+	// so the requests are never blocked by the audit.
+	auditBuffer = 10000
+	// auditBatch is the maximal number of records inserted at once.
+	auditBatch = 500
+	// auditFlushInterval is the period the buffered records are written with.
+	auditFlushInterval = time.Second
+	// auditSweepInterval is the period the records older than the retention are removed with.
+	auditSweepInterval = time.Hour
+	// defaultAuditRetention is the period the records are kept for by default.
+	defaultAuditRetention = 30 * 24 * time.Hour
+)
+
+// Keys of the gin context values overriding the defaults of the audit record.
+const (
+	auditActionKey = "config:audit_action"
+	auditTypeKey   = "config:audit_type"
+	auditNameKey   = "config:audit_name"
+	auditItemsKey  = "config:audit_items"
+)
+
+// Outcomes of the audited requests.
+const (
+	outcomeSuccess  = "success"
+	outcomeDenied   = "denied"
+	outcomeRejected = "rejected"
+	outcomeError    = "error"
+)
+
+// AuditRecord describes a single handled request. The records are append-only,
+// the database rejects their updates and only the retention removes them.
+type AuditRecord struct {
+	ID        int64     `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Principal string    `json:"principal"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Action    string    `json:"action"`
+	Type      string    `json:"type"`
+	Name      string    `json:"name"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+}
+
+// auditLog writes the audit records in the background.
+type auditLog struct {
+	db        *gorm.DB
+	retention time.Duration
+	records   chan AuditRecord
+	flushes   chan chan struct{}
+	// dropped counts the records lost for the full buffer.
+	dropped int64
+}
+
+// newAuditLog creates the log keeping the records for the retention period, zero retention keeps them forever.
+func newAuditLog(db *gorm.DB, retention time.Duration) *auditLog {
+	return &auditLog{
+		db:        db,
+		retention: retention,
+		records:   make(chan AuditRecord, auditBuffer),
+		flushes:   make(chan chan struct{}),
+	}
+}
+
+// add queues the record for the write without blocking.
+func (a *auditLog) add(record AuditRecord) {
+	select {
+	case a.records <- record:
+	default:
+		if atomic.AddInt64(&a.dropped, 1)%1000 == 1 {
+			log.Printf("audit buffer is full, %v records dropped", atomic.LoadInt64(&a.dropped))
+		}
+	}
+}
+
+// flush waits until the records queued before it are written.
+func (a *auditLog) flush() {
+	done := make(chan struct{})
+	a.flushes <- done
+	<-done
+}
+
+// run writes the queued records and removes the expired ones.
+func (a *auditLog) run() {
+	flush := time.NewTicker(auditFlushInterval)
+	defer flush.Stop()
+	sweep := time.NewTicker(auditSweepInterval)
+	defer sweep.Stop()
+	a.sweep()
+
+	var batch []AuditRecord
+	for {
+		select {
+		case record := <-a.records:
+			batch = append(batch, record)
+			if len(batch) >= auditBatch {
+				batch = a.write(batch)
+			}
+		case <-flush.C:
+			batch = a.write(batch)
+		case done := <-a.flushes:
+			for len(a.records) != 0 {
+				batch = append(batch, <-a.records)
+			}
+			batch = a.write(batch)
+			close(done)
+		case <-sweep.C:
+			a.sweep()
+		}
+	}
+}
+
+// write inserts the records and returns the emptied batch. The failed batch is dropped,
+// so the broken db does not make the records pile up.
+func (a *auditLog) write(batch []AuditRecord) []AuditRecord {
+	for len(batch) != 0 {
+		n := len(batch)
+		if n > auditBatch {
+			n = auditBatch
+		}
+
+		values := make([]string, n)
+		args := make([]interface{}, 0, n*10)
+		for i, r := range batch[:n] {
+			values[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+			args = append(args, r.CreatedAt, r.Principal, r.ClientIP, r.Method, r.Path, r.Action, r.Type, r.Name, r.Status, r.Outcome)
+		}
+		err := a.db.Exec(`INSERT INTO "audit_records" ("created_at", "principal", "client_ip", "method", "path",
+			"action", "type", "name", "status", "outcome") VALUES `+strings.Join(values, ", "), args...).Error
+		if err != nil {
+			log.Printf("failed to write %v audit records: %v", n, err)
+		}
+		batch = batch[n:]
+	}
+	return batch[:0]
+}
+
+// sweep removes the records older than the retention period.
+func (a *auditLog) sweep() {
+	if a.retention <= 0 {
+		return
+	}
+	res := a.db.Where("created_at < ?", time.Now().Add(-a.retention)).Delete(&AuditRecord{})
+	if res.Error != nil {
+		log.Printf("failed to remove expired audit records: %v", res.Error)
+	} else if res.RowsAffected != 0 {
+		log.Printf("%v expired audit records removed", res.RowsAffected)
+	}
+}
+
+// auditItem is the config and the status of a single item of the request handling several configs.
+type auditItem struct {
+	Type   string
+	Name   string
+	Status int
+}
+
+// audit is a gin middleware recording every handled request in the audit log.
+// The action is `read` for GET requests, `delete` for DELETE and `write` for the others
+// unless the handler sets it explicitly, the config is taken from the path parameters by default.
+// The requests handling several configs are recorded once per item set by auditItems.
+func (s configServer) audit(c *gin.Context) {
+	c.Next()
+	if s.auditLog == nil {
+		return
+	}
+
+	principal := "anonymous"
+	if token := requestToken(c); token != nil {
+		principal = token.Owner
+	}
+	action := c.GetString(auditActionKey)
+	if action == "" {
+		switch c.Request.Method {
+		case "GET", "HEAD":
+			action = accessRead
+		case "DELETE":
+			action = "delete"
+		default:
+			action = accessWrite
+		}
+	}
+	typ, name := c.Param("type"), c.Param("name")
+	if value, ok := c.Get(auditTypeKey); ok {
+		typ, name = value.(string), c.GetString(auditNameKey)
+	}
+
+	record := AuditRecord{
+		CreatedAt: time.Now(),
+		Principal: principal,
+		ClientIP:  clientAddr(c),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Action:    action,
+		Type:      typ,
+		Name:      name,
+		Status:    c.Writer.Status(),
+		Outcome:   auditOutcome(c.Writer.Status()),
+	}
+	value, ok := c.Get(auditItemsKey)
+	if !ok {
+		s.auditLog.add(record)
+		return
+	}
+	for _, item := range value.([]auditItem) {
+		record.Type, record.Name = item.Type, item.Name
+		record.Status, record.Outcome = item.Status, auditOutcome(item.Status)
+		s.auditLog.add(record)
+	}
+}
+
+// clientAddr returns the address of the peer connection. The forwarding headers are ignored,
+// any client may set them and forge the address recorded in the audit log or in the revisions.
+func clientAddr(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// auditItems makes the request recorded once per item, the status of the item is the one
+// the request of the single config would get.
+func auditItems(c *gin.Context, items []auditItem) {
+	c.Set(auditItemsKey, items)
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return outcomeDenied
+	case status >= 500:
+		return outcomeError
+	case status >= 400:
+		return outcomeRejected
+	default:
+		return outcomeSuccess
+	}
+}
+
+// auditConfig sets the action and the config of the audit record of the request
+// handled without the path parameters.
+func auditConfig(c *gin.Context, action, typ, name string) {
+	c.Set(auditActionKey, action)
+	c.Set(auditTypeKey, typ)
+	c.Set(auditNameKey, name)
+}
+
+// handleAudit lists the audit records, the newest ones go first:
+// `GET /audit?principal=...&type=...&name=...&action=...&outcome=...&since=...&until=...&cursor=...&limit=...`.
+// The times are in RFC 3339. The admin access to the filtered configs is required, see authorizeAudit.
+func (s configServer) handleAudit(c *gin.Context) {
+	if !authorizeAudit(c, c.Query("type"), c.Query("name")) {
+		return
+	}
+	limit, cursor, ok := pageParams(c, 1)
+	if !ok {
+		return
+	}
+
+	query := s.db.Model(&AuditRecord{})
+	for _, filter := range []string{"principal", "type", "name", "action", "outcome"} {
+		if value := c.Query(filter); value != "" {
+			query = query.Where(filter+" = ?", value)
+		}
+	}
+	for _, bound := range []struct{ param, cond string }{{"since", "created_at >= ?"}, {"until", "created_at < ?"}} {
+		str := c.Query(bound.param)
+		if str == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			log.Printf("invalid audit %v time '%v': %v", bound.param, str, err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid time",
+			})
+			return
+		}
+		query = query.Where(bound.cond, at)
+	}
+	if cursor != nil {
+		last, err := strconv.ParseInt(cursor[0], 10, 64)
+		if err != nil {
+			log.Printf("invalid audit cursor: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid cursor",
+			})
+			return
+		}
+		query = query.Where("id < ?", last)
+	}
+
+	var reply listReply
+	records := []AuditRecord{}
+	err := query.Order("id DESC").Limit(limit + 1).Find(&records).Error
+	if err != nil {
+		replyDBError(c, "failed to list audit records", err)
+		return
+	}
+	if len(records) > limit {
+		records = records[:limit]
+		reply.Next = encodeCursor(strconv.FormatInt(records[limit-1].ID, 10))
+	}
+	reply.Items = records
+	c.JSON(http.StatusOK, reply)
+}
+
+// authorizeAudit ensures that the caller may administer all configs the audit filter matches:
+// the config if both the type and the name are given, all configs of the type if only the type is,
+// and all configs of all types otherwise. It replies with 403 otherwise.
+func authorizeAudit(c *gin.Context, typ, name string) bool {
+	switch {
+	case typ != "" && name != "":
+		return authorize(c, accessAdmin, typ, name)
+	case typ != "":
+		return authorizeType(c, accessAdmin, typ)
+	case allowedAll(c, accessAdmin, ""):
+		return true
+	}
+	replyForbidden(c, accessAdmin, "*", "*")
+	return false
+}
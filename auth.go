@@ -0,0 +1,476 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
+)
+
+// Access levels of the scopes. Write and secrets access include the read one.
+// Metrics access allows only the service counters(see authorizeMetrics), it is granted by `metrics:*:*`.
+const (
+	accessRead    = "read"
+	accessWrite   = "write"
+	accessSecrets = "secrets"
+	accessMetrics = "metrics"
+)
+
+// tokenKey is the key of the gin context value with the *APIToken of the authenticated request.
+const tokenKey = "config:token"
+
+// tokenCacheTTL is the period the known tokens are cached for, it bounds the delay of the revocation.
+const tokenCacheTTL = 10 * time.Second
+
+// tokenPrefix starts the generated tokens, so they are easy to recognize in the leaked texts.
+const tokenPrefix = "cfg_"
+
+// APIToken grants the access to the configs matching its scopes,
+// the roles bound to its owner grant more(see RoleBinding). Only the hash of the token is stored.
+type APIToken struct {
+	ID        uint   `gorm:"primary_key"`
+	Hash      string `gorm:"unique_index"`
+	Owner     string
+	Scopes    pq.StringArray `gorm:"type:text[]"`
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+
+	// Parsed Scopes, they are filled on the load.
+	scopes []scope
+	// Rules of the roles bound to the owner, they are filled on the authentication.
+	rules []boundRule
+}
+
+// scope grants the access to the configs which type and name match the globs(see path.Match):
+// `<access>:<type glob>:<name glob>`, e.g. `read:database.*:service.test`.
+type scope struct {
+	access   string
+	typeGlob string
+	nameGlob string
+}
+
+func parseScope(str string) (scope, error) {
+	parts := strings.SplitN(str, ":", 3)
+	if len(parts) != 3 {
+		return scope{}, fmt.Errorf("scope '%v' must be in the form of `access:type:name`", str)
+	}
+	sc := scope{
+		access:   parts[0],
+		typeGlob: parts[1],
+		nameGlob: parts[2],
+	}
+	switch sc.access {
+	case accessRead, accessWrite, accessSecrets, accessMetrics:
+	default:
+		return scope{}, fmt.Errorf("scope '%v': unknown access '%v'", str, sc.access)
+	}
+	for _, glob := range []string{sc.typeGlob, sc.nameGlob} {
+		if _, err := path.Match(glob, ""); err != nil || glob == "" {
+			return scope{}, fmt.Errorf("scope '%v': invalid pattern '%v'", str, glob)
+		}
+	}
+	return sc, nil
+}
+
+func (sc scope) grants(access string) bool {
+	return sc.access == access || access == accessRead && sc.access != accessMetrics
+}
+
+func (sc scope) allows(access, typ, name string) bool {
+	if !sc.grants(access) {
+		return false
+	}
+	typeMatch, _ := path.Match(sc.typeGlob, typ)
+	nameMatch, _ := path.Match(sc.nameGlob, name)
+	return typeMatch && nameMatch
+}
+
+// AfterFind parses the scopes of the loaded token.
+func (t *APIToken) AfterFind() error {
+	t.scopes = nil
+	for _, str := range t.Scopes {
+		sc, err := parseScope(str)
+		if err != nil {
+			// The tokens are created with the valid scopes, the broken ones just grant nothing.
+			log.Printf("ignoring invalid scope of the token %v: %v", t.ID, err)
+			continue
+		}
+		t.scopes = append(t.scopes, sc)
+	}
+	return nil
+}
+
+// allows checks whether the token grants the access to the config by its scopes or by the roles of the owner.
+// Any matching deny rule of the roles overrides the grants.
+func (t *APIToken) allows(access, typ, name string) bool {
+	allowed := false
+	for _, sc := range t.scopes {
+		if sc.allows(access, typ, name) {
+			allowed = true
+			break
+		}
+	}
+	for _, rule := range t.rules {
+		if rule.matches(access, typ, name) {
+			if rule.Effect == effectDeny {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// allowsType checks whether the token grants the access to some configs of the type.
+func (t *APIToken) allowsType(access, typ string) bool {
+	allowed := false
+	for _, sc := range t.scopes {
+		if match, _ := path.Match(sc.typeGlob, typ); match && sc.grants(access) {
+			allowed = true
+			break
+		}
+	}
+	for _, rule := range t.rules {
+		if !rule.hasAction(access) {
+			continue
+		}
+		switch {
+		case rule.Effect == effectDeny && rule.coversType(typ):
+			return false
+		case rule.Effect == effectAllow && rule.matchesType(typ):
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// allowsAll checks whether the token grants the access to all configs of the type, of all types if typ is empty.
+// Only the scopes and the allow rules covering all the names count, while any deny rule
+// which may apply to some of the configs refuses the access.
+func (t *APIToken) allowsAll(access, typ string) bool {
+	allowed := false
+	for _, sc := range t.scopes {
+		if sc.grants(access) && globCovers(sc.typeGlob, typ) && sc.nameGlob == "*" {
+			allowed = true
+			break
+		}
+	}
+	for _, rule := range t.rules {
+		if !rule.hasAction(access) {
+			continue
+		}
+		switch {
+		case rule.Effect == effectDeny && (typ == "" || rule.matchesType(typ)):
+			return false
+		case rule.Effect == effectAllow && rule.coversType(typ):
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createToken stores a new token and returns it, the token can not be recovered later.
+// Zero ttl means that the token does not expire.
+func createToken(db *gorm.DB, owner string, ttl time.Duration, scopes []string) (string, error) {
+	if owner == "" {
+		return "", errors.New("owner required")
+	}
+	for _, str := range scopes {
+		if _, err := parseScope(str); err != nil {
+			return "", err
+		}
+	}
+
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+	record := APIToken{
+		Hash:   hashToken(token),
+		Owner:  owner,
+		Scopes: scopes,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+	err = db.Create(&record).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeToken removes the token by its id.
+func revokeToken(db *gorm.DB, id string) error {
+	res := db.Where("id = ?", id).Delete(&APIToken{})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return errors.New("token not found")
+	}
+	return res.Error
+}
+
+// tokenCache keeps the recently used tokens by their hashes.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[string]tokenCacheEntry
+}
+
+type tokenCacheEntry struct {
+	token   *APIToken
+	expires time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		entries: make(map[string]tokenCacheEntry),
+	}
+}
+
+// findToken returns the token by its hash, it is nil for the unknown token.
+func (s configServer) findToken(hash string) (*APIToken, error) {
+	now := time.Now()
+	s.tokens.mu.Lock()
+	entry, ok := s.tokens.entries[hash]
+	if ok && now.After(entry.expires) {
+		delete(s.tokens.entries, hash)
+		ok = false
+	}
+	s.tokens.mu.Unlock()
+	if ok {
+		return entry.token, nil
+	}
+
+	token := &APIToken{}
+	res := s.db.Where("hash = ?", hash).First(token)
+	switch {
+	case res.RecordNotFound():
+		// The unknown tokens are not cached, so the random ones can not flood the cache.
+		return nil, nil
+	case res.Error != nil:
+		return nil, res.Error
+	}
+
+	s.tokens.mu.Lock()
+	s.tokens.entries[hash] = tokenCacheEntry{
+		token:   token,
+		expires: now.Add(tokenCacheTTL),
+	}
+	s.tokens.mu.Unlock()
+	return token, nil
+}
+
+// authenticate is a gin middleware requiring a valid bearer token in the Authorization header
+// or a verified client certificate with the mapped identity(see clientIdentities).
+// The token is never logged.
+func (s configServer) authenticate(c *gin.Context) {
+	var token *APIToken
+	header := c.GetHeader("Authorization")
+	if header == "" && c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) != 0 {
+		cert := c.Request.TLS.VerifiedChains[0][0]
+		token = s.identities.certToken(cert)
+		if token == nil {
+			replyUnauthorized(c, fmt.Sprintf("client certificate '%v' is not mapped to any identity", cert.Subject.CommonName))
+			return
+		}
+	} else {
+		if !strings.HasPrefix(header, "Bearer ") {
+			replyUnauthorized(c, "bearer token required")
+			return
+		}
+
+		var err error
+		token, err = s.findToken(hashToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))))
+		switch {
+		case err != nil:
+			replyDBError(c, "failed to load token", err)
+			c.Abort()
+			return
+		case token == nil:
+			replyUnauthorized(c, "invalid token")
+			return
+		case token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now()):
+			log.Printf("expired token %v of '%v' rejected", token.ID, token.Owner)
+			replyUnauthorized(c, "token expired")
+			return
+		}
+	}
+
+	rules, err := s.principalRules(token.Owner)
+	if err != nil {
+		replyDBError(c, "failed to load rules", err)
+		c.Abort()
+		return
+	}
+	// The cached token is shared by the requests, the rules are attached to the copy.
+	authenticated := *token
+	authenticated.rules = rules
+	c.Set(tokenKey, &authenticated)
+}
+
+func replyUnauthorized(c *gin.Context, msg string) {
+	log.Printf("request rejected: %v", msg)
+	c.Header("WWW-Authenticate", `Bearer realm="config"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"error": msg,
+	})
+}
+
+// requestToken returns the token of the authenticated request, it is nil if the authentication is disabled.
+func requestToken(c *gin.Context) *APIToken {
+	token, _ := c.Get(tokenKey)
+	t, _ := token.(*APIToken)
+	return t
+}
+
+// allowed checks whether the caller has the access to the config.
+// Any access is allowed if the authentication is disabled.
+func allowed(c *gin.Context, access, typ, name string) bool {
+	token := requestToken(c)
+	return token == nil || token.allows(access, typ, name)
+}
+
+// allowedType checks whether the caller has the access to some configs of the type.
+func allowedType(c *gin.Context, access, typ string) bool {
+	token := requestToken(c)
+	return token == nil || token.allowsType(access, typ)
+}
+
+// allowedAll checks whether the caller has the access to all configs of the type, of all types if typ is empty.
+func allowedAll(c *gin.Context, access, typ string) bool {
+	token := requestToken(c)
+	return token == nil || token.allowsAll(access, typ)
+}
+
+// authorizeType replies with 403 if the caller has no access to all configs of the type.
+func authorizeType(c *gin.Context, access, typ string) bool {
+	if allowedAll(c, access, typ) {
+		return true
+	}
+	replyForbidden(c, access, typ, "*")
+	return false
+}
+
+// authorize replies with 403 if the caller has no access to the config.
+func authorize(c *gin.Context, access, typ, name string) bool {
+	if allowed(c, access, typ, name) {
+		return true
+	}
+	replyForbidden(c, access, typ, name)
+	return false
+}
+
+// authorizeMetrics ensures that the caller may read the service counters, they include the sizes of the types,
+// so the metrics or the admin access to all configs is required. It replies with 403 otherwise.
+func authorizeMetrics(c *gin.Context) bool {
+	if allowedAll(c, accessAdmin, "") || allowedAll(c, accessMetrics, "") {
+		return true
+	}
+	replyForbidden(c, accessMetrics, "*", "*")
+	return false
+}
+
+func replyForbidden(c *gin.Context, access, typ, name string) {
+	log.Printf("%v access to config '%v' with type '%v' denied for '%v'", access, name, typ, requestToken(c).Owner)
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": "access denied",
+	})
+}
+
+// authorizeDependencies ensures that the caller may read the layers and the referenced configs
+// of the data being written, so they can not be disclosed through the config. The references to the whole data
+// or to the secret fields and the secret fields inherited from the layers require the secrets access
+// to the referenced config or the layer. It replies with 403 otherwise.
+func (s configServer) authorizeDependencies(c *gin.Context, typ, name string, data []byte) bool {
+	if requestToken(c) == nil {
+		return true
+	}
+
+	var obj map[string]interface{}
+	if hasLayers(data) && decodeJSON(data, &obj) == nil {
+		parents, _ := extendsOf("", obj)
+		for _, parent := range parents {
+			if !authorize(c, accessRead, typ, parent) {
+				return false
+			}
+		}
+	}
+
+	for _, match := range refPattern.FindAllSubmatch(data, -1) {
+		if match[0][1] == '$' {
+			// Escaped reference.
+			continue
+		}
+		target, key := string(match[1]), ""
+		if i := strings.LastIndex(target, "#"); i >= 0 {
+			target, key = target[:i], target[i+1:]
+		}
+		parts := strings.SplitN(target, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if !authorize(c, accessRead, parts[0], parts[1]) {
+			return false
+		}
+		if (key == "" || s.secretKey(parts[0], key)) && !canReadSecrets(c, parts[0], parts[1]) {
+			replyForbidden(c, accessSecrets, parts[0], parts[1])
+			return false
+		}
+	}
+
+	// The referenced objects may contain the secret fields as well as the referenced configs may reference
+	// the secrets of others, and the layers may contribute their secret fields to the merged data,
+	// so the data is resolved with the secrets the caller can not read masked.
+	// The unresolvable data is left to the validation.
+	config := &Config{Type: typ, Name: name, Data: postgres.Jsonb{RawMessage: data}}
+	_, _, secrets, err := resolveMasked(config, s.getConfig, s.referenceMask(c, false))
+	if err == nil && len(secrets) != 0 {
+		log.Printf("secret fields %v of the layers or the referenced configs denied for '%v'", secrets, requestToken(c).Owner)
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "access denied",
+		})
+		return false
+	}
+	return true
+}
+
+// secretKey checks whether the dotted key of the config data of the type is a secret field
+// or is nested in one, by the naming convention or by the schema.
+func (s configServer) secretKey(typ, key string) bool {
+	// The schema only marks more fields as secret, so the naming convention still applies without it.
+	node, _ := s.schemaDocument(typ)
+	for _, part := range strings.Split(key, ".") {
+		if isSecretName(part) {
+			return true
+		}
+		schema, _ := node.(map[string]interface{})
+		properties, _ := schema["properties"].(map[string]interface{})
+		property, _ := properties[part].(map[string]interface{})
+		if marked, _ := property["secret"].(bool); marked {
+			return true
+		}
+		node = property
+	}
+	return false
+}
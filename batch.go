@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchSize limits the number of configs in a single batch request,
+// it keeps the size of the query condition reasonable.
+const maxBatchSize = 100
+
+// Statuses of the items in a batch reply.
+const (
+	batchFound    = "found"
+	batchNotFound = "not found"
+	batchError    = "error"
+)
+
+// batchResult is a reply for the single item of a batch request.
+type batchResult struct {
+	Type   string
+	Name   string `json:"Data"`
+	Status string `json:"status"`
+	// Matched is the name of the config found by the hierarchical name resolution.
+	Matched string          `json:"matched,omitempty"`
+	Config  json.RawMessage `json:"config,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// handleBatch resolves a list of lookup requests. The items are taken from the snapshot or the cache,
+// the misses are loaded with a single query(see loadBatch).
+// The reply contains the results in the order of the request, misses and invalid items
+// are reported per item and do not fail the whole batch. Every item gets its own audit record.
+func (s configServer) handleBatch(c *gin.Context) {
+	c.Set(auditActionKey, accessRead)
+	var requests []lookupRequest
+	err := c.BindJSON(&requests)
+	if err != nil {
+		log.Printf("failed to decode batch request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+
+	if len(requests) > maxBatchSize {
+		log.Printf("too large batch request: %v items", len(requests))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "too many items",
+		})
+		return
+	}
+
+	results := make([]batchResult, len(requests))
+	items := make([]auditItem, len(requests))
+	candidates := make([][]string, len(requests))
+	var keys []cacheKey
+	for i, req := range requests {
+		results[i] = batchResult{
+			Type:   req.Type,
+			Name:   req.Name,
+			Status: batchNotFound,
+		}
+		items[i] = auditItem{req.Type, req.Name, http.StatusNotFound}
+		if req.Type == "" || req.Name == "" {
+			results[i].Status = batchError
+			results[i].Error = "empty type or data"
+			items[i].Status = http.StatusBadRequest
+			continue
+		}
+		if !allowed(c, accessRead, req.Type, req.Name) {
+			results[i].Status = batchError
+			results[i].Error = "access denied"
+			items[i].Status = http.StatusForbidden
+			continue
+		}
+		candidates[i] = []string{req.Name}
+		if req.Fallback {
+			candidates[i] = fallbackNames(req.Name)
+		}
+		for _, name := range candidates[i] {
+			keys = append(keys, cacheKey{req.Type, name})
+		}
+	}
+
+	found, err := s.loadBatch(keys)
+	if err != nil {
+		replyDBError(c, "failed to load batch of configs", err)
+		return
+	}
+
+	for i, req := range requests {
+		var config *Config
+		for _, name := range candidates[i] {
+			if config = found[cacheKey{req.Type, name}]; config != nil {
+				break
+			}
+		}
+		if config == nil {
+			continue
+		}
+		// The fallback may match a config the caller can not read.
+		if config.Name != req.Name {
+			if !allowed(c, accessRead, req.Type, config.Name) {
+				results[i].Status = batchError
+				results[i].Error = "access denied"
+				items[i].Status = http.StatusForbidden
+				continue
+			}
+			results[i].Matched = config.Name
+		}
+
+		data, _, _, err := resolveMasked(config, s.getConfig, s.referenceMask(c, false))
+		if err != nil {
+			log.Printf("failed to resolve config '%v' with type '%v': %v", config.Name, req.Type, err)
+			results[i].Status = batchError
+			results[i].Error = "failed to resolve config"
+			items[i].Status = http.StatusInternalServerError
+			if _, ok := err.(*refError); ok {
+				results[i].Error = err.Error()
+				items[i].Status = http.StatusUnprocessableEntity
+			}
+			continue
+		}
+		data, ok := s.visibleData(c, req.Type, config.Name, data)
+		if !ok {
+			return
+		}
+		results[i].Status = batchFound
+		results[i].Config = data
+		items[i].Status = http.StatusOK
+	}
+
+	auditItems(c, items)
+	c.JSON(http.StatusOK, results)
+}
+
+// loadBatch returns the existing configs by the keys. They are taken from the snapshot or the cache,
+// the misses are loaded with a single query and cached.
+func (s configServer) loadBatch(keys []cacheKey) (map[cacheKey]*Config, error) {
+	found := make(map[cacheKey]*Config, len(keys))
+	if s.snapshot != nil {
+		for _, key := range keys {
+			if config := s.snapshot.get(key.Type, key.Name); config != nil {
+				found[key] = config
+			}
+		}
+		return found, nil
+	}
+
+	// misses keeps the cache generations of the keys to load.
+	misses := make(map[cacheKey]uint64)
+	var conds []string
+	var args []interface{}
+	for _, key := range keys {
+		if _, ok := misses[key]; ok || found[key] != nil {
+			continue
+		}
+		config, generation, cached := s.cache.get(key.Type, key.Name)
+		switch {
+		case !cached:
+			misses[key] = generation
+			conds = append(conds, "(?, ?)")
+			args = append(args, key.Type, key.Name)
+		case config != nil:
+			found[key] = config
+		}
+	}
+	if len(conds) == 0 {
+		return found, nil
+	}
+
+	var configs []Config
+	err := s.db.Where("(type, name) IN ("+strings.Join(conds, ", ")+")", args...).Find(&configs).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range configs {
+		found[cacheKey{configs[i].Type, configs[i].Name}] = &configs[i]
+	}
+	// The missing configs are cached as well.
+	for key, generation := range misses {
+		s.cache.put(key.Type, key.Name, found[key], generation)
+	}
+	return found, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults of the cache settings.
+const (
+	defaultCacheSize        = 10000
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 5 * time.Second
+)
+
+// configCache is a bounded LRU cache of the configs keyed by (type, name).
+// Missing configs are cached as nil for a shorter period.
+// Zero TTL disables the cache.
+type configCache struct {
+	hits, misses int64
+
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	// Most recently used entries go first.
+	lru *list.List
+	// generation is incremented by each invalidation, so the data loaded before
+	// the invalidation is not put into the cache after it.
+	generation uint64
+}
+
+type cacheKey struct {
+	Type, Name string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	config  *Config
+	expires time.Time
+}
+
+func newConfigCache(size int, ttl, negativeTTL time.Duration) *configCache {
+	return &configCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[cacheKey]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// get returns the cached config, it is nil for the missing config.
+// ok is false on cache miss, generation has to be passed to the put of the loaded config then.
+func (cache *configCache) get(typ, name string) (config *Config, generation uint64, ok bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.entries[cacheKey{typ, name}]
+	if ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cache.lru.MoveToFront(elem)
+			atomic.AddInt64(&cache.hits, 1)
+			return entry.config, 0, true
+		}
+		cache.remove(elem)
+	}
+	atomic.AddInt64(&cache.misses, 1)
+	return nil, cache.generation, false
+}
+
+// put caches the config loaded at the generation returned by get.
+func (cache *configCache) put(typ, name string, config *Config, generation uint64) {
+	ttl := cache.ttl
+	if config == nil {
+		ttl = cache.negativeTTL
+	}
+	if ttl <= 0 || cache.size <= 0 {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if generation != cache.generation {
+		// The config may have been changed since it was loaded.
+		return
+	}
+	key := cacheKey{typ, name}
+	if elem, ok := cache.entries[key]; ok {
+		cache.remove(elem)
+	}
+	cache.entries[key] = cache.lru.PushFront(&cacheEntry{
+		key:     key,
+		config:  config,
+		expires: time.Now().Add(ttl),
+	})
+	for cache.lru.Len() > cache.size {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// invalidate drops the cached state of the config.
+func (cache *configCache) invalidate(typ, name string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.generation++
+	if elem, ok := cache.entries[cacheKey{typ, name}]; ok {
+		cache.remove(elem)
+	}
+}
+
+// clear drops all the cached configs.
+func (cache *configCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.generation++
+	cache.entries = make(map[cacheKey]*list.Element)
+	cache.lru.Init()
+}
+
+func (cache *configCache) remove(elem *list.Element) {
+	cache.lru.Remove(elem)
+	delete(cache.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (cache *configCache) len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.lru.Len()
+}
+
+// follow invalidates the configs changed by other server instances until the process exits.
+func (cache *configCache) follow(feed *changeFeed) {
+	for {
+		sub := feed.subscribe(func(changeEvent) bool {
+			return true
+		})
+		for event := range sub.events {
+			cache.invalidate(event.Type, event.Name)
+		}
+		// The subscription is dropped for lagging behind, so some events may be missed.
+		log.Println("config cache lost change events, clearing it")
+		cache.clear()
+	}
+}
+
+// handleCacheStats replies with the counters of the config cache.
+func (s configServer) handleCacheStats(c *gin.Context) {
+	if !authorizeMetrics(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"hits":   atomic.LoadInt64(&s.cache.hits),
+		"misses": atomic.LoadInt64(&s.cache.misses),
+		"size":   s.cache.len(),
+	})
+}
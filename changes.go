@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions of the change events.
+const (
+	actionCreated = "created"
+	actionUpdated = "updated"
+	actionDeleted = "deleted"
+)
+
+const (
+	// feedPollInterval is the period of the revisions table polling, it bounds the delay
+	// of the changes made by other server instances while the notifications are not listened.
+	feedPollInterval = time.Second
+	// subscriptionBuffer is the number of events a subscriber may lag behind before being dropped.
+	subscriptionBuffer = 64
+)
+
+// changeEvent describes a single change of a config.
+type changeEvent struct {
+	// Global id of the revision, it orders all the changes.
+	ID       int64  `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Revision int    `json:"revision"`
+	Action   string `json:"action"`
+}
+
+// loadChangeEvents loads the events of the revisions matching the query in the order of their ids.
+// The data of the revisions is not loaded, so a revision which can not be decrypted does not stall the events.
+func loadChangeEvents(query *gorm.DB) ([]changeEvent, error) {
+	rows, err := query.Model(&Revision{}).
+		Select("id, type, name, revision, old_data IS NULL, new_data IS NULL").
+		Order("id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []changeEvent
+	for rows.Next() {
+		var event changeEvent
+		var created, deleted bool
+		err = rows.Scan(&event.ID, &event.Type, &event.Name, &event.Revision, &created, &deleted)
+		if err != nil {
+			return nil, err
+		}
+		event.Action = actionUpdated
+		switch {
+		case created:
+			event.Action = actionCreated
+		case deleted:
+			event.Action = actionDeleted
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// changeFeed delivers the changes recorded in the revisions table to the subscribers.
+// Ids of the revisions are assigned in the commit order(see recordRevision),
+// so the feed just reads the revisions with ids above the last seen one.
+type changeFeed struct {
+	db   *gorm.DB
+	wake chan struct{}
+	// Id of the last delivered revision, it is accessed by the run() goroutine only.
+	last int64
+	// listening is non-zero while the notifications are received(see listen).
+	listening int32
+
+	mu          sync.Mutex
+	subscribers map[*subscription]struct{}
+}
+
+// subscription receives the events matching its filter.
+// The channel is closed if the subscriber does not keep up with the events.
+type subscription struct {
+	events chan changeEvent
+	filter func(changeEvent) bool
+	feed   *changeFeed
+}
+
+func newChangeFeed(db *gorm.DB) *changeFeed {
+	return &changeFeed{
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		subscribers: make(map[*subscription]struct{}),
+	}
+}
+
+// run polls the revisions table until the process exits.
+// Besides the periodic polling, it reacts to notify() calls immediately.
+func (f *changeFeed) run() {
+	err := f.db.Model(&Revision{}).Select("COALESCE(MAX(id), 0)").Row().Scan(&f.last)
+	if err != nil {
+		// The first poll will deliver the whole history, which is harmless for the subscribers.
+		log.Printf("failed to load last revision id: %v", err)
+	}
+
+	ticker := time.NewTicker(feedPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&f.listening) != 0 {
+				continue
+			}
+		case <-f.wake:
+		}
+		f.poll()
+	}
+}
+
+// notify asks the feed to poll the changes without waiting for the next tick.
+func (f *changeFeed) notify() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+		// The poll is already pending.
+	}
+}
+
+func (f *changeFeed) poll() {
+	events, err := loadChangeEvents(f.db.Where("id > ?", f.last))
+	if err != nil {
+		log.Printf("failed to poll revisions: %v", err)
+		return
+	}
+
+	for _, event := range events {
+		f.publish(event)
+		f.last = event.ID
+	}
+}
+
+func (f *changeFeed) publish(event changeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for sub := range f.subscribers {
+		if !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			log.Println("dropping subscriber lagging behind the change feed")
+			delete(f.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe starts the delivery of the future events matching the filter.
+func (f *changeFeed) subscribe(filter func(changeEvent) bool) *subscription {
+	sub := &subscription{
+		events: make(chan changeEvent, subscriptionBuffer),
+		filter: filter,
+		feed:   f,
+	}
+
+	f.mu.Lock()
+	f.subscribers[sub] = struct{}{}
+	f.mu.Unlock()
+	return sub
+}
+
+// close stops the delivery of the events.
+func (sub *subscription) close() {
+	f := sub.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lookupGroup collapses the concurrent loads of the same config into a single query,
+// its result is shared by all the waiters.
+type lookupGroup struct {
+	// queries counts the performed queries, coalesced counts the loads served by the queries of others.
+	queries, coalesced int64
+
+	mu    sync.Mutex
+	calls map[cacheKey]*lookupCall
+}
+
+// errLookupPanicked is returned to the waiters of the load which has panicked.
+var errLookupPanicked = errors.New("config lookup panicked")
+
+type lookupCall struct {
+	done   chan struct{}
+	config *Config
+	err    error
+}
+
+func newLookupGroup() *lookupGroup {
+	return &lookupGroup{
+		calls: make(map[cacheKey]*lookupCall),
+	}
+}
+
+// do calls load unless the load of the same config is already in flight,
+// the result of the in-flight load is returned then.
+func (g *lookupGroup) do(typ, name string, load func() (*Config, error)) (*Config, error) {
+	key := cacheKey{typ, name}
+
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		atomic.AddInt64(&g.coalesced, 1)
+		<-call.done
+		return call.config, call.err
+	}
+	call := &lookupCall{
+		done: make(chan struct{}),
+	}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	// The call is finished even if load panics, so the waiters and the later loads are not blocked forever.
+	// The error is kept for the waiters then.
+	call.err = errLookupPanicked
+	defer func() {
+		g.mu.Lock()
+		// The call may have been forgotten and replaced by a newer one.
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	atomic.AddInt64(&g.queries, 1)
+	call.config, call.err = load()
+	return call.config, call.err
+}
+
+// forget makes the later loads of the config start a new query instead of joining the in-flight one,
+// which may have read the state before the change. It is called once the change is committed.
+func (g *lookupGroup) forget(typ, name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.calls, cacheKey{typ, name})
+}
+
+// handleLookupStats replies with the counters of the lookup coalescing.
+func (s configServer) handleLookupStats(c *gin.Context) {
+	if !authorizeMetrics(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"queries":   atomic.LoadInt64(&s.lookups.queries),
+		"coalesced": atomic.LoadInt64(&s.lookups.coalesced),
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dataETag returns a strong entity tag for the config data.
+// The data is re-encoded before hashing, so the tag does not depend on the key order or the formatting.
+func dataETag(data json.RawMessage) string {
+	canonical := []byte(data)
+	var value interface{}
+	if decodeJSON(data, &value) == nil {
+		// encoding/json writes the keys of maps in the sorted order.
+		encoded, err := json.Marshal(value)
+		if err == nil {
+			canonical = encoded
+		}
+	}
+
+	sum := sha256.Sum256(canonical)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified sets the validators of the reply and checks the conditional headers of GET and HEAD requests.
+// It replies with 304 and returns true if the client already has the actual data.
+// Zero modified time means that the modification time is unknown.
+func notModified(c *gin.Context, etag string, modified time.Time) bool {
+	c.Header("ETag", etag)
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	// The conditions have other semantics for the unsafe methods, the lookups by POST just ignore them.
+	if c.Request.Method != "GET" && c.Request.Method != "HEAD" {
+		return false
+	}
+
+	// If-Modified-Since is ignored in presence of If-None-Match as RFC 7232 requires.
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		if !etagMatches(header, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+		// Last-Modified has a precision of seconds.
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+
+	c.Status(http.StatusNotModified)
+	return true
+}
+
+// etagMatches checks whether If-None-Match header matches the tag.
+// The comparison is weak, so W/ prefixes are ignored.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatchesStrong checks whether If-Match header matches the tag. The comparison is strong(RFC 7232),
+// so the weak tags never match.
+func etagMatchesStrong(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// versionHeader carries the version of the config in replies.
+const versionHeader = "X-Config-Version"
+
+// setVersion sets the validators of the current config state in the reply headers.
+// ETag is omitted if the data can not be resolved.
+func (s configServer) setVersion(c *gin.Context, config *Config) {
+	etag, err := s.servedETag(c, config)
+	if err != nil {
+		log.Printf("failed to compute ETag of config '%v' with type '%v': %v", config.Name, config.Type, err)
+	} else {
+		c.Header("ETag", etag)
+	}
+	c.Header(versionHeader, strconv.Itoa(config.Version))
+}
+
+// servedETag returns the tag of the config data the way the lookup serves it to the caller:
+// merged with the layers, with the references resolved and the secrets masked unless the caller may read them.
+func (s configServer) servedETag(c *gin.Context, config *Config) (string, error) {
+	data, _, _, err := resolveMasked(config, s.getConfig, s.referenceMask(c, false))
+	if err != nil {
+		return "", err
+	}
+	if !canReadSecrets(c, config.Type, config.Name) {
+		data, _, err = s.maskSecrets(config.Type, data)
+		if err != nil {
+			return "", err
+		}
+	}
+	return dataETag(data), nil
+}
+
+// checkPrecondition compares the state of the config with the If-Match header
+// or the `version` query parameter, current is nil for the missing config.
+// If-Match is compared with the tag the caller is given(see servedETag). For the callers without the secrets access
+// it is computed over the masked data, they can not write the mask back over the secrets though(see checkMasked).
+// It replies with 412 on mismatch or with 428 if the precondition is required but not passed.
+func (s configServer) checkPrecondition(c *gin.Context, current *Config, required bool) bool {
+	ifMatch := c.GetHeader("If-Match")
+	version := c.Query("version")
+
+	var ok bool
+	switch {
+	case ifMatch == "" && version == "":
+		if !required {
+			return true
+		}
+		log.Println("precondition required for the update")
+		c.JSON(http.StatusPreconditionRequired, gin.H{
+			"error": "If-Match header or version parameter required",
+		})
+		return false
+
+	// Any precondition fails for the missing config, If-Match: * as well.
+	case current == nil:
+		ok = false
+	case ifMatch != "":
+		etag, err := s.servedETag(c, current)
+		if err != nil {
+			// The unresolvable data matches only `*`, so it still can be fixed.
+			log.Printf("failed to compute ETag of config '%v' with type '%v': %v", current.Name, current.Type, err)
+			etag = "*"
+		}
+		ok = etagMatchesStrong(ifMatch, etag)
+	default:
+		ok = version == strconv.Itoa(current.Version)
+	}
+	if ok {
+		return true
+	}
+
+	currentVersion := 0
+	if current != nil {
+		s.setVersion(c, current)
+		currentVersion = current.Version
+	}
+	log.Printf("precondition failed: If-Match '%v', version '%v', current version %v", ifMatch, version, currentVersion)
+	c.JSON(http.StatusPreconditionFailed, gin.H{
+		"error":   "version mismatch",
+		"version": currentVersion,
+	})
+	return false
+}
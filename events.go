@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// keepAliveInterval is the period of comments sent to idle event streams,
+	// so proxies do not close the connection.
+	keepAliveInterval = 15 * time.Second
+	// backlogChunk is the number of revisions loaded at once on the stream resumption.
+	backlogChunk = 1000
+)
+
+// handleEvents streams the changes of configs as Server-Sent Events:
+// `GET /events?type_prefix=...&name_prefix=...`.
+// The ids of the events are the global ids of the revisions. A client passing the id of
+// the last received event in the Last-Event-ID header(or the `last_event_id` parameter)
+// gets all the changes it has missed before the live ones.
+// Only the changes of the configs the caller can read are streamed.
+func (s configServer) handleEvents(c *gin.Context) {
+	typePrefix, namePrefix := c.Query("type_prefix"), c.Query("name_prefix")
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		// EventSource in browsers can not set headers for the first connection.
+		lastEventID = c.Query("last_event_id")
+	}
+	// Negative id means that only the live events are requested.
+	lastID := int64(-1)
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastID < 0 {
+			log.Printf("invalid last event id '%v'", lastEventID)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid last event id",
+			})
+			return
+		}
+	}
+
+	// The filter runs on the change feed goroutine, so it checks the token captured here
+	// instead of reading the context of the request concurrently.
+	token := requestToken(c)
+	readable := func(event changeEvent) bool {
+		return token == nil || token.allows(accessRead, event.Type, event.Name)
+	}
+
+	// The subscription goes first, so nothing is missed between the backlog and the live events.
+	sub := s.feed.subscribe(func(event changeEvent) bool {
+		return strings.HasPrefix(event.Type, typePrefix) && strings.HasPrefix(event.Name, namePrefix) && readable(event)
+	})
+	defer sub.close()
+
+	// The missed revisions are loaded and sent chunk by chunk, lastID is the last loaded one.
+	// backlogDone is set once the last chunk is loaded.
+	var backlog []changeEvent
+	backlogDone := lastID < 0
+	loadBacklog := func() error {
+		query := s.db.Where("id > ?", lastID)
+		if typePrefix != "" {
+			query = query.Where("type LIKE ?", likePrefix(typePrefix))
+		}
+		if namePrefix != "" {
+			query = query.Where("name LIKE ?", likePrefix(namePrefix))
+		}
+
+		events, err := loadChangeEvents(query.Limit(backlogChunk))
+		if err != nil {
+			return err
+		}
+		backlog = backlog[:0]
+		for _, event := range events {
+			if readable(event) {
+				backlog = append(backlog, event)
+			}
+			lastID = event.ID
+		}
+		backlogDone = len(events) < backlogChunk
+		return nil
+	}
+	// The first chunk is loaded before the reply, so the failure is reported with the status.
+	if !backlogDone {
+		err := loadBacklog()
+		if err != nil {
+			replyDBError(c, "failed to load missed revisions", err)
+			return
+		}
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Content-Type", sse.ContentType)
+	c.Status(http.StatusOK)
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		if len(backlog) != 0 {
+			writeEvent(w, backlog[0])
+			backlog = backlog[1:]
+			return true
+		}
+		if !backlogDone {
+			err := loadBacklog()
+			if err != nil {
+				// The client will resume from the last received event after reconnection.
+				log.Printf("failed to load missed revisions: %v", err)
+				return false
+			}
+			return true
+		}
+
+		select {
+		case event, open := <-sub.events:
+			if !open {
+				// The client lags behind, it will resume from the last received event after reconnection.
+				return false
+			}
+			// The live events may repeat the backlog, which is loaded up to lastID.
+			if event.ID > lastID {
+				writeEvent(w, event)
+				lastID = event.ID
+			}
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+func writeEvent(w io.Writer, event changeEvent) {
+	err := sse.Encode(w, sse.Event{
+		Id:    strconv.FormatInt(event.ID, 10),
+		Event: event.Action,
+		Data:  event,
+	})
+	if err != nil {
+		log.Printf("failed to write event: %v", err)
+	}
+}
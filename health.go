@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readyTimeout bounds the db ping of the readiness check.
+const readyTimeout = 2 * time.Second
+
+// Statuses of the health checks.
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// healthCheck is the result of a single check of the health endpoints.
+type healthCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// registerHealth attaches the liveness and readiness probes to r. They are meant to be registered
+// before the authentication and the audit, so the probes need no credentials and do not flood the audit.
+func (s *configServer) registerHealth(r gin.IRoutes) {
+	r.GET("/healthz", s.handleHealth)
+	r.GET("/readyz", s.handleReady)
+}
+
+// handleHealth tells that the process is alive and serves the requests.
+func (s configServer) handleHealth(c *gin.Context) {
+	replyChecks(c, []healthCheck{{
+		Name:     "process",
+		Status:   checkOK,
+		Duration: "0s",
+	}})
+}
+
+// handleReady checks that the db is reachable and its migrations match the service,
+// it replies with 503 if any check fails.
+func (s configServer) handleReady(c *gin.Context) {
+	database := runCheck("database", func() error {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+		defer cancel()
+		return s.db.DB().PingContext(ctx)
+	})
+	migrations := healthCheck{
+		Name:     "migrations",
+		Status:   checkSkipped,
+		Duration: "0s",
+	}
+	if database.Status == checkOK {
+		migrations = runCheck("migrations", func() error {
+			return ensureMigration(s.db)
+		})
+	}
+	replyChecks(c, []healthCheck{database, migrations})
+}
+
+// runCheck runs the check and measures its duration. The probes need no credentials,
+// so the details of the failure are only logged and the reply tells just a generic error.
+func runCheck(name string, check func() error) healthCheck {
+	start := time.Now()
+	err := check()
+	result := healthCheck{
+		Name:     name,
+		Status:   checkOK,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		log.Printf("%v check failed: %v", name, err)
+		result.Status, result.Error = checkFailed, name+" check failed"
+	}
+	return result
+}
+
+// replyChecks replies with the results of the checks, the status is 503 unless all of them passed or were skipped.
+func replyChecks(c *gin.Context, checks []healthCheck) {
+	status, code := checkOK, http.StatusOK
+	for _, check := range checks {
+		if check.Status == checkFailed {
+			status, code = checkFailed, http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": checks,
+	})
+}
@@ -0,0 +1,544 @@
+// Package jsonschema implements validation of JSON documents against a subset of JSON Schema(draft 7).
+//
+// Supported keywords:
+// type, enum, const, properties, required, additionalProperties, minProperties, maxProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern,
+// minimum, maximum, exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf, not.
+// Annotations like title or description are ignored, references are not supported.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a parsed JSON Schema document ready for validation.
+type Schema struct {
+	// Boolean schemas: true accepts anything, false rejects anything.
+	// Other keywords are empty for them.
+	reject bool
+
+	types    []string
+	enum     []interface{}
+	hasConst bool
+	constant interface{}
+
+	properties    map[string]*Schema
+	required      []string
+	additional    *Schema
+	minProperties *int
+	maxProperties *int
+
+	items    *Schema
+	minItems *int
+	maxItems *int
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+// Violation describes a single mismatch between a document and a schema.
+type Violation struct {
+	// Path to the offending value in the document, like `$.servers[0].port`.
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// ValidationError is returned if the document does not match the schema.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	return "document does not match the schema: " + strings.Join(e.Strings(), "; ")
+}
+
+// Strings returns the descriptions of all the violations.
+func (e *ValidationError) Strings() []string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return msgs
+}
+
+// Parse parses the schema document.
+func Parse(data []byte) (*Schema, error) {
+	var doc interface{}
+	err := decode(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema json: %v", err)
+	}
+	return parse(doc, "$")
+}
+
+// Validate checks the JSON document against the schema.
+// It returns *ValidationError if the document is a valid JSON but does not match the schema.
+func (s *Schema) Validate(data []byte) error {
+	var doc interface{}
+	err := decode(data, &doc)
+	if err != nil {
+		return fmt.Errorf("invalid json: %v", err)
+	}
+
+	violations := s.validate(doc, "$")
+	if len(violations) != 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// decode unmarshals the JSON keeping numbers as json.Number, so integers are not rounded.
+func decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(v)
+	if err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after the top-level value")
+	}
+	return nil
+}
+
+var knownTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"string":  true,
+	"integer": true,
+}
+
+// parse converts the decoded schema document, path is used in error messages only.
+func parse(doc interface{}, path string) (*Schema, error) {
+	if accept, ok := doc.(bool); ok {
+		return &Schema{reject: !accept}, nil
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: schema must be an object or a boolean", path)
+	}
+
+	s := &Schema{}
+	var err error
+	for key, value := range obj {
+		keyPath := path + "." + key
+		switch key {
+		case "type":
+			s.types, err = parseTypes(value, keyPath)
+
+		case "enum":
+			values, ok := value.([]interface{})
+			if !ok {
+				err = fmt.Errorf("%v: must be an array", keyPath)
+			}
+			s.enum = values
+
+		case "const":
+			s.hasConst = true
+			s.constant = value
+
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("%v: must be an object", keyPath)
+				break
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for name, prop := range props {
+				s.properties[name], err = parse(prop, keyPath+"."+name)
+				if err != nil {
+					break
+				}
+			}
+
+		case "required":
+			s.required, err = parseStrings(value, keyPath)
+
+		case "additionalProperties":
+			s.additional, err = parse(value, keyPath)
+
+		case "items":
+			s.items, err = parse(value, keyPath)
+
+		case "allOf":
+			s.allOf, err = parseList(value, keyPath)
+		case "anyOf":
+			s.anyOf, err = parseList(value, keyPath)
+		case "oneOf":
+			s.oneOf, err = parseList(value, keyPath)
+		case "not":
+			s.not, err = parse(value, keyPath)
+
+		case "minProperties":
+			s.minProperties, err = parseCount(value, keyPath)
+		case "maxProperties":
+			s.maxProperties, err = parseCount(value, keyPath)
+		case "minItems":
+			s.minItems, err = parseCount(value, keyPath)
+		case "maxItems":
+			s.maxItems, err = parseCount(value, keyPath)
+		case "minLength":
+			s.minLength, err = parseCount(value, keyPath)
+		case "maxLength":
+			s.maxLength, err = parseCount(value, keyPath)
+
+		case "pattern":
+			str, ok := value.(string)
+			if !ok {
+				err = fmt.Errorf("%v: must be a string", keyPath)
+				break
+			}
+			s.pattern, err = regexp.Compile(str)
+			if err != nil {
+				err = fmt.Errorf("%v: %v", keyPath, err)
+			}
+
+		case "minimum":
+			s.minimum, err = parseNumber(value, keyPath)
+		case "maximum":
+			s.maximum, err = parseNumber(value, keyPath)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = parseNumber(value, keyPath)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = parseNumber(value, keyPath)
+
+		case "$ref", "$id", "definitions", "patternProperties", "dependencies", "if", "then", "else",
+			"contains", "uniqueItems", "multipleOf", "propertyNames", "additionalItems":
+			// Silently ignoring these would accept documents the author meant to reject.
+			err = fmt.Errorf("%v: keyword is not supported", keyPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func parseTypes(value interface{}, path string) ([]string, error) {
+	var types []string
+	if str, ok := value.(string); ok {
+		types = []string{str}
+	} else {
+		var err error
+		types, err = parseStrings(value, path)
+		if err != nil {
+			return nil, fmt.Errorf("%v: must be a string or an array of strings", path)
+		}
+	}
+	for _, typ := range types {
+		if !knownTypes[typ] {
+			return nil, fmt.Errorf("%v: unknown type '%v'", path, typ)
+		}
+	}
+	return types, nil
+}
+
+func parseStrings(value interface{}, path string) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: must be an array of strings", path)
+	}
+	strs := make([]string, len(values))
+	for i, value := range values {
+		strs[i], ok = value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v: must be an array of strings", path)
+		}
+	}
+	return strs, nil
+}
+
+func parseList(value interface{}, path string) ([]*Schema, error) {
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("%v: must be a non-empty array of schemas", path)
+	}
+	list := make([]*Schema, len(values))
+	for i, value := range values {
+		var err error
+		list[i], err = parse(value, fmt.Sprintf("%v[%v]", path, i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func parseCount(value interface{}, path string) (*int, error) {
+	num, ok := value.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%v: must be a non-negative integer", path)
+	}
+	count, err := strconv.Atoi(num.String())
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("%v: must be a non-negative integer", path)
+	}
+	return &count, nil
+}
+
+func parseNumber(value interface{}, path string) (*float64, error) {
+	num, ok := value.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%v: must be a number", path)
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &f, nil
+}
+
+// validate returns the list of violations for the value located at path.
+func (s *Schema) validate(value interface{}, path string) []Violation {
+	if s.reject {
+		return []Violation{{path, "no value is allowed here"}}
+	}
+
+	var violations []Violation
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{path, fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.types) != 0 && !matchesType(value, s.types) {
+		fail("expected %v, got %v", strings.Join(s.types, " or "), typeOf(value))
+		// The other checks make no sense for the value of unexpected type.
+		return violations
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, option := range s.enum {
+			if equal(value, option) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed options")
+		}
+	}
+	if s.hasConst && !equal(value, s.constant) {
+		fail("value does not match the constant")
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		violations = append(violations, s.validateObject(value, path)...)
+	case []interface{}:
+		if s.minItems != nil && len(value) < *s.minItems {
+			fail("expected at least %v items, got %v", *s.minItems, len(value))
+		}
+		if s.maxItems != nil && len(value) > *s.maxItems {
+			fail("expected at most %v items, got %v", *s.maxItems, len(value))
+		}
+		if s.items != nil {
+			for i, item := range value {
+				violations = append(violations, s.items.validate(item, fmt.Sprintf("%v[%v]", path, i))...)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.minLength != nil && length < *s.minLength {
+			fail("expected at least %v characters, got %v", *s.minLength, length)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("expected at most %v characters, got %v", *s.maxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			fail("string does not match pattern '%v'", s.pattern)
+		}
+	case json.Number:
+		num, _ := value.Float64()
+		if s.minimum != nil && num < *s.minimum {
+			fail("expected a number >= %v, got %v", *s.minimum, value)
+		}
+		if s.maximum != nil && num > *s.maximum {
+			fail("expected a number <= %v, got %v", *s.maximum, value)
+		}
+		if s.exclusiveMinimum != nil && num <= *s.exclusiveMinimum {
+			fail("expected a number > %v, got %v", *s.exclusiveMinimum, value)
+		}
+		if s.exclusiveMaximum != nil && num >= *s.exclusiveMaximum {
+			fail("expected a number < %v, got %v", *s.exclusiveMaximum, value)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		violations = append(violations, sub.validate(value, path)...)
+	}
+	if s.anyOf != nil && countMatches(s.anyOf, value, path) == 0 {
+		fail("value does not match any of the allowed schemas")
+	}
+	if s.oneOf != nil {
+		if n := countMatches(s.oneOf, value, path); n != 1 {
+			fail("value must match exactly one schema, matches %v", n)
+		}
+	}
+	if s.not != nil && len(s.not.validate(value, path)) == 0 {
+		fail("value matches the forbidden schema")
+	}
+
+	return violations
+}
+
+func (s *Schema) validateObject(obj map[string]interface{}, path string) []Violation {
+	var violations []Violation
+
+	if s.minProperties != nil && len(obj) < *s.minProperties {
+		violations = append(violations, Violation{path,
+			fmt.Sprintf("expected at least %v properties, got %v", *s.minProperties, len(obj))})
+	}
+	if s.maxProperties != nil && len(obj) > *s.maxProperties {
+		violations = append(violations, Violation{path,
+			fmt.Sprintf("expected at most %v properties, got %v", *s.maxProperties, len(obj))})
+	}
+
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			violations = append(violations, Violation{propertyPath(path, name), "required property is missing"})
+		}
+	}
+
+	// Sorted keys make the order of violations stable.
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		prop, ok := s.properties[key]
+		switch {
+		case ok:
+			violations = append(violations, prop.validate(obj[key], propertyPath(path, key))...)
+		case s.additional != nil && s.additional.reject:
+			violations = append(violations, Violation{propertyPath(path, key), "property is not allowed"})
+		case s.additional != nil:
+			violations = append(violations, s.additional.validate(obj[key], propertyPath(path, key))...)
+		}
+	}
+
+	return violations
+}
+
+func countMatches(schemas []*Schema, value interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		if len(sub.validate(value, path)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// propertyPath appends the property name to the path,
+// names which are not identifiers are quoted: `$["a.b"]`.
+func propertyPath(path, name string) string {
+	if identRegexp.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func matchesType(value interface{}, types []string) bool {
+	actual := typeOf(value)
+	for _, typ := range types {
+		if typ == actual {
+			return true
+		}
+		if typ == "integer" && actual == "number" {
+			num, err := value.(json.Number).Float64()
+			if err == nil && num == math.Trunc(num) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// equal compares decoded JSON values, numbers are equal if they have the same value(1 == 1.0).
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, errA := a.Float64()
+		bf, errB := b.Float64()
+		return errA == nil && errB == nil && af == bf
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,121 @@
+package jsonschema
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSchema = `
+{
+	"type": "object",
+	"required": ["host", "port"],
+	"additionalProperties": false,
+	"properties": {
+		"host": {"type": "string", "minLength": 1},
+		"port": {"type": "string", "pattern": "^[0-9]+$"},
+		"retries": {"type": "integer", "minimum": 0, "maximum": 10},
+		"mode": {"enum": ["ro", "rw"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"tls": {"anyOf": [{"type": "boolean"}, {"type": "object", "required": ["ca"]}]},
+		"odd.name": {"not": {"const": 1}}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	schema, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("failed to parse the schema: %v", err)
+	}
+
+	tests := []struct {
+		doc        string
+		violations []string
+	}{
+		{
+			doc: `{"host": "localhost", "port": "5432"}`,
+		},
+		{
+			doc: `{"host": "localhost", "port": "5432", "retries": 3.0, "mode": "ro",
+				"tags": ["a"], "tls": {"ca": "..."}, "odd.name": 2}`,
+		},
+		{
+			doc:        `[]`,
+			violations: []string{"$: expected object, got array"},
+		},
+		{
+			doc: `{"host": "", "prot": "5432"}`,
+			violations: []string{
+				"$.port: required property is missing",
+				"$.host: expected at least 1 characters, got 0",
+				"$.prot: property is not allowed",
+			},
+		},
+		{
+			doc: `{"host": "h", "port": 5432, "retries": 1.5, "mode": "wo",
+				"tags": ["a", 1, "c"], "tls": {}, "odd.name": 1}`,
+			violations: []string{
+				"$.mode: value is not one of the allowed options",
+				`$["odd.name"]: value matches the forbidden schema`,
+				"$.port: expected string, got number",
+				"$.retries: expected integer, got number",
+				"$.tags: expected at most 2 items, got 3",
+				"$.tags[1]: expected string, got number",
+				"$.tls: value does not match any of the allowed schemas",
+			},
+		},
+		{
+			doc:        `{"host": "h", "port": "x", "retries": 11}`,
+			violations: []string{"$.port: string does not match pattern '^[0-9]+$'", "$.retries: expected a number <= 10, got 11"},
+		},
+	}
+
+	for _, test := range tests {
+		err := schema.Validate([]byte(test.doc))
+		if test.violations == nil {
+			if err != nil {
+				t.Errorf("document %v: unexpected error: %v", test.doc, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("document %v: ValidationError expected, got %v", test.doc, err)
+			continue
+		}
+		if !reflect.DeepEqual(verr.Strings(), test.violations) {
+			t.Errorf("document %v: unexpected violations:\n%q\nbut\n%q\nexpected", test.doc, verr.Strings(), test.violations)
+		}
+	}
+
+	if _, ok := schema.Validate([]byte(`{`)).(*ValidationError); ok {
+		t.Errorf("invalid json reported as a schema violation")
+	}
+}
+
+func TestParse(t *testing.T) {
+	invalid := []string{
+		`{`,
+		`"object"`,
+		`{"type": "float"}`,
+		`{"required": "host"}`,
+		`{"properties": {"port": {"minimum": "1"}}}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+		`{"$ref": "#/definitions/port"}`,
+	}
+	for _, doc := range invalid {
+		_, err := Parse([]byte(doc))
+		if err == nil {
+			t.Errorf("schema %v: Parse() did not fail", doc)
+		}
+	}
+
+	schema, err := Parse([]byte(`false`))
+	if err != nil {
+		t.Fatalf("failed to parse boolean schema: %v", err)
+	}
+	if schema.Validate([]byte(`{}`)) == nil {
+		t.Errorf("false schema accepted the document")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/betrok/test-config-server/jsonschema"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// Reserved keys of the config data describing the layers.
+const (
+	// extendsKey lists the names of the parent configs of the same type,
+	// the later parents override the earlier ones and the config overrides all of them.
+	extendsKey = "$extends"
+	// abstractKey marks the configs used as the layers only,
+	// they are not validated against the schema on their own.
+	abstractKey = "$abstract"
+)
+
+// maxLayerDepth limits the length of the parent chains.
+const maxLayerDepth = 8
+
+// layerError describes the layers which can not be resolved.
+type layerError string
+
+func (e layerError) Error() string {
+	return string(e)
+}
+
+// configLoader loads the config, it returns nil if the config does not exist.
+type configLoader func(typ, name string) (*Config, error)
+
+// layer is the data of a single config in the resolved chain.
+type layer struct {
+	name string
+	data map[string]interface{}
+}
+
+// hasLayers is a cheap check whether the data may use the reserved keys and needs the resolution.
+func hasLayers(data []byte) bool {
+	return bytes.Contains(data, []byte(`"`+extendsKey+`"`)) || bytes.Contains(data, []byte(`"`+abstractKey+`"`))
+}
+
+// resolveLayers returns the layers of the config from the base to the config itself.
+// A parent shared by several layers is applied once, before all of them.
+func resolveLayers(config *Config, load configLoader) ([]layer, error) {
+	var layers []layer
+	applied := map[string]bool{}
+
+	// path holds the chain from the config to the current layer.
+	var visit func(name string, data []byte, path []string) error
+	visit = func(name string, data []byte, path []string) error {
+		if len(path) > maxLayerDepth {
+			return layerError(fmt.Sprintf("layers are nested deeper than %v: %v", maxLayerDepth, strings.Join(path, " -> ")))
+		}
+
+		var obj map[string]interface{}
+		err := decodeJSON(data, &obj)
+		if err != nil {
+			return err
+		}
+		parents, err := extendsOf(name, obj)
+		if err != nil {
+			return err
+		}
+
+		for _, parent := range parents {
+			chain := append(path[:len(path):len(path)], parent)
+			for _, ancestor := range path {
+				if ancestor == parent {
+					return layerError("layers form a cycle: " + strings.Join(chain, " -> "))
+				}
+			}
+			if applied[parent] {
+				continue
+			}
+
+			layerConfig, err := load(config.Type, parent)
+			if err != nil {
+				return err
+			}
+			if layerConfig == nil {
+				return layerError(fmt.Sprintf("layer '%v' of '%v' does not exist", parent, name))
+			}
+			err = visit(parent, layerConfig.Data.RawMessage, chain)
+			if err != nil {
+				return err
+			}
+		}
+
+		applied[name] = true
+		layers = append(layers, layer{
+			name: name,
+			data: obj,
+		})
+		return nil
+	}
+
+	err := visit(config.Name, config.Data.RawMessage, []string{config.Name})
+	return layers, err
+}
+
+// maskLayers masks the secret fields of the parent layers the caller can not read(see secretMask),
+// so they are not disclosed through the configs extending the layers. The last layer is the config itself.
+func maskLayers(typ string, layers []layer, mask secretMask) error {
+	if mask == nil {
+		return nil
+	}
+	for _, l := range layers[:len(layers)-1] {
+		err := mask(typ, l.name, l.data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extendsOf(name string, obj map[string]interface{}) ([]string, error) {
+	value, ok := obj[extendsKey]
+	if !ok {
+		return nil, nil
+	}
+
+	list, _ := value.([]interface{})
+	parents := make([]string, len(list))
+	for i, item := range list {
+		parents[i], _ = item.(string)
+		if parents[i] == "" {
+			list = nil
+			break
+		}
+	}
+	if list == nil {
+		return nil, layerError(fmt.Sprintf("%v of '%v' must be an array of config names", extendsKey, name))
+	}
+	return parents, nil
+}
+
+// isAbstract checks whether the layer is marked as abstract.
+func (l layer) isAbstract() bool {
+	abstract, _ := l.data[abstractKey].(bool)
+	return abstract
+}
+
+// mergeLayers deep-merges the layers: objects are merged key by key, null deletes the key
+// and any other value(arrays as well) replaces the previous one.
+// If sources is not nil, it receives the name of the layer each resulting value came from,
+// keyed by the dotted path of the value.
+func mergeLayers(layers []layer, sources map[string]string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, l := range layers {
+		data := make(map[string]interface{}, len(l.data))
+		for key, value := range l.data {
+			if key != extendsKey && key != abstractKey {
+				data[key] = value
+			}
+		}
+		mergeLayer(result, data, l.name, "", sources)
+	}
+	return result
+}
+
+func mergeLayer(target, patch map[string]interface{}, name, path string, sources map[string]string) {
+	for key, value := range patch {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+			forgetSources(sources, keyPath)
+		case map[string]interface{}:
+			nested, ok := target[key].(map[string]interface{})
+			if !ok {
+				nested = map[string]interface{}{}
+				target[key] = nested
+				forgetSources(sources, keyPath)
+			}
+			mergeLayer(nested, value, name, keyPath, sources)
+		default:
+			target[key] = value
+			if sources != nil {
+				forgetSources(sources, keyPath)
+				sources[keyPath] = name
+			}
+		}
+	}
+}
+
+// forgetSources drops the sources of the value at the path and of all the nested values.
+func forgetSources(sources map[string]string, path string) {
+	for key := range sources {
+		if key == path || strings.HasPrefix(key, path+".") {
+			delete(sources, key)
+		}
+	}
+}
+
+// checkDependents ensures that the config is not a layer of other configs, so it can be removed.
+func (c *Config) checkDependents(tx *gorm.DB) error {
+	names, err := dependents(tx, c.Type, c.Name)
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return layerError(fmt.Sprintf("config is a layer of %v", strings.Join(names, ", ")))
+	}
+	return nil
+}
+
+// dependents returns the sorted names of the configs extending the config directly.
+func dependents(tx *gorm.DB, typ, name string) ([]string, error) {
+	parent, err := json.Marshal([]string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = tx.Model(&Config{}).Where("type = ? AND data->'"+extendsKey+"' @> ?::jsonb", typ, string(parent)).
+		Order("name").Pluck("name", &names).Error
+	return names, err
+}
+
+// validateDependents checks the configs extending the config, directly or through other layers,
+// as they will be served with the new data of the config: their layers must be resolvable
+// and their merged data must match the schema of the type.
+func (c *Config) validateDependents(tx *gorm.DB) error {
+	load := txLoader(tx)
+	// The config itself is not saved yet.
+	overlay := func(typ, name string) (*Config, error) {
+		if typ == c.Type && name == c.Name {
+			return c, nil
+		}
+		return load(typ, name)
+	}
+
+	// The schema is loaded only if there are dependents, it stays nil if the type has no schema.
+	var schema *jsonschema.Schema
+	schemaLoaded := false
+	mismatches := dependentsError{}
+	visited := map[string]bool{c.Name: true}
+	for queue := []string{c.Name}; len(queue) != 0; queue = queue[1:] {
+		names, err := dependents(tx, c.Type, queue[0])
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if visited[name] {
+				continue
+			}
+			visited[name] = true
+			queue = append(queue, name)
+
+			if !schemaLoaded {
+				stored, err := shareSchema(tx, c.Type)
+				if err == nil && stored != nil {
+					schema, err = jsonschema.Parse(stored.Document.RawMessage)
+					if err != nil {
+						err = fmt.Errorf("invalid schema stored for type '%v': %v", c.Type, err)
+					}
+				}
+				if err != nil {
+					return err
+				}
+				schemaLoaded = true
+			}
+
+			dependent, err := load(c.Type, name)
+			if err != nil {
+				return err
+			}
+			if dependent == nil {
+				continue
+			}
+			data, abstract, err := resolveData(dependent, overlay)
+			if err == nil && !abstract && schema != nil {
+				err = schema.Validate(data)
+			}
+			if err != nil {
+				mismatches[name] = violations(err)
+			}
+		}
+	}
+	if len(mismatches) != 0 {
+		return mismatches
+	}
+	return nil
+}
+
+// dependentsError maps the names of the configs extending the changed layer, which would become invalid,
+// to their violations.
+type dependentsError map[string][]string
+
+func (e dependentsError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "configs extending the layer would become invalid: " + strings.Join(names, ", ")
+}
+
+// txLoader loads the configs within the transaction.
+func txLoader(tx *gorm.DB) configLoader {
+	return func(typ, name string) (*Config, error) {
+		config := &Config{
+			Type: typ,
+			Name: name,
+		}
+		res := tx.First(config)
+		switch {
+		case res.RecordNotFound():
+			return nil, nil
+		case res.Error != nil:
+			return nil, res.Error
+		}
+		return config, nil
+	}
+}
+
+// handleLayers serves the debug view of the layers: `GET /configs/:type/:name/layers`.
+// The reply contains the names of the layers in the order of application, the merged data
+// and the name of the layer each value came from.
+func (s configServer) handleLayers(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessRead, typ, name) {
+		return
+	}
+
+	config, ok := s.findConfig(c, typ, name)
+	if !ok {
+		return
+	}
+	if config == nil {
+		replyNotFound(c, typ, name)
+		return
+	}
+
+	layers, err := resolveLayers(config, s.getConfig)
+	if err == nil {
+		err = maskLayers(typ, layers, s.referenceMask(c, false))
+	}
+	if err != nil {
+		replyResolveError(c, typ, name, err)
+		return
+	}
+	names := make([]string, len(layers))
+	for i, l := range layers {
+		names[i] = l.name
+	}
+	sources := map[string]string{}
+	merged, err := json.Marshal(mergeLayers(layers, sources))
+	if err != nil {
+		replyResolveError(c, typ, name, err)
+		return
+	}
+	data, ok := s.visibleData(c, typ, name, merged)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"layers":  names,
+		"data":    data,
+		"sources": sources,
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes of the listing requests.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// listReply is a single page of a listing.
+// Next is an opaque cursor for the following page, it is empty on the last one.
+type listReply struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// handleTypes lists distinct config types: `GET /types?prefix=...&cursor=...&limit=...`.
+func (s configServer) handleTypes(c *gin.Context) {
+	limit, cursor, ok := pageParams(c, 1)
+	if !ok {
+		return
+	}
+
+	query := s.db.Model(&Config{})
+	if prefix := c.Query("prefix"); prefix != "" {
+		query = query.Where("type LIKE ?", likePrefix(prefix))
+	}
+	if cursor != nil {
+		query = query.Where("type > ?", cursor[0])
+	}
+
+	types := []string{}
+	err := query.Order("type").Limit(limit+1).Pluck("DISTINCT type", &types).Error
+	if err != nil {
+		replyDBError(c, "failed to list config types", err)
+		return
+	}
+
+	reply := listReply{}
+	if len(types) > limit {
+		types = types[:limit]
+		reply.Next = encodeCursor(types[limit-1])
+	}
+	// The types the caller has no access to are skipped, so the page may be shorter than the limit.
+	visible := []string{}
+	for _, typ := range types {
+		if allowedType(c, accessRead, typ) {
+			visible = append(visible, typ)
+		}
+	}
+	reply.Items = visible
+	c.JSON(http.StatusOK, reply)
+}
+
+// handleNames lists names of the configs with the given type:
+// `GET /configs/:type?prefix=...&cursor=...&limit=...`.
+func (s configServer) handleNames(c *gin.Context) {
+	limit, cursor, ok := pageParams(c, 1)
+	if !ok {
+		return
+	}
+
+	typ := c.Param("type")
+	query := s.db.Model(&Config{}).Where("type = ?", typ)
+	if prefix := c.Query("prefix"); prefix != "" {
+		query = query.Where("name LIKE ?", likePrefix(prefix))
+	}
+	if cursor != nil {
+		query = query.Where("name > ?", cursor[0])
+	}
+
+	names := []string{}
+	err := query.Order("name").Limit(limit+1).Pluck("name", &names).Error
+	if err != nil {
+		replyDBError(c, "failed to list config names", err)
+		return
+	}
+
+	reply := listReply{}
+	if len(names) > limit {
+		names = names[:limit]
+		reply.Next = encodeCursor(names[limit-1])
+	}
+	visible := []string{}
+	for _, name := range names {
+		if allowed(c, accessRead, typ, name) {
+			visible = append(visible, name)
+		}
+	}
+	reply.Items = visible
+	c.JSON(http.StatusOK, reply)
+}
+
+// handleKeys lists (type, name) keys of all configs:
+// `GET /configs?type_prefix=...&name_prefix=...&cursor=...&limit=...`.
+// The keys are ordered by the primary key, so the pages are cheap to seek.
+func (s configServer) handleKeys(c *gin.Context) {
+	limit, cursor, ok := pageParams(c, 2)
+	if !ok {
+		return
+	}
+
+	query := s.db.Select("type, name")
+	if prefix := c.Query("type_prefix"); prefix != "" {
+		query = query.Where("type LIKE ?", likePrefix(prefix))
+	}
+	if prefix := c.Query("name_prefix"); prefix != "" {
+		query = query.Where("name LIKE ?", likePrefix(prefix))
+	}
+	if cursor != nil {
+		query = query.Where("(type, name) > (?, ?)", cursor[0], cursor[1])
+	}
+
+	var configs []Config
+	err := query.Order("type, name").Limit(limit + 1).Find(&configs).Error
+	if err != nil {
+		replyDBError(c, "failed to list config keys", err)
+		return
+	}
+
+	reply := listReply{}
+	if len(configs) > limit {
+		configs = configs[:limit]
+		last := configs[limit-1]
+		reply.Next = encodeCursor(last.Type, last.Name)
+	}
+	keys := make([]lookupRequest, 0, len(configs))
+	for _, config := range configs {
+		if allowed(c, accessRead, config.Type, config.Name) {
+			keys = append(keys, lookupRequest{Type: config.Type, Name: config.Name})
+		}
+	}
+	reply.Items = keys
+	c.JSON(http.StatusOK, reply)
+}
+
+// pageParams parses the limit and the cursor of a listing request,
+// the cursor must consist of parts values and is nil for the first page.
+// It replies with 400 if any parameter is invalid.
+func pageParams(c *gin.Context, parts int) (limit int, cursor []string, ok bool) {
+	limit = defaultPageSize
+	if str := c.Query("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			log.Printf("invalid page limit '%v'", str)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid limit",
+			})
+			return 0, nil, false
+		}
+	}
+
+	if str := c.Query("cursor"); str != "" {
+		var err error
+		cursor, err = decodeCursor(str, parts)
+		if err != nil {
+			log.Printf("invalid page cursor '%v': %v", str, err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid cursor",
+			})
+			return 0, nil, false
+		}
+	}
+
+	return limit, cursor, true
+}
+
+// encodeCursor packs the last key of the page into an url-safe string.
+func encodeCursor(key ...string) string {
+	data, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string, parts int) ([]string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var key []string
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != parts {
+		return nil, errors.New("unexpected number of key parts")
+	}
+	return key, nil
+}
+
+// likePrefix returns LIKE pattern matching all strings with the given prefix.
+func likePrefix(prefix string) string {
+	// Backslash is the default escape character in Postgres.
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
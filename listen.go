@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// changesChannel is the channel notified by the trigger on configs(see migration 0080).
+	changesChannel = "config_changes"
+	// schemasChannel is the channel notified with the types of the changed schemas(see migration 0120).
+	schemasChannel = "schema_changes"
+
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+	// listenerPingInterval is the period of the connection checks in absence of notifications.
+	listenerPingInterval = 30 * time.Second
+)
+
+// listen wakes the feed up on the notifications about the changes of configs,
+// so the changes made by other server instances are delivered without the polling delay.
+// The periodic polling is suspended while the listener is connected and resumes on disconnection.
+// Notifications sent while the connection was down are lost, but the revisions are not:
+// after reconnection the feed resyncs by reading all the revisions since the last delivered one.
+// The notifications about the schema changes invalidate the schemas cached by the instance,
+// all of them are dropped after reconnection.
+func (f *changeFeed) listen(dsn string, schemas *schemaCache) {
+	listener := pq.NewListener(dsn, listenerMinReconnect, listenerMaxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected:
+			log.Printf("listening to '%v' notifications", changesChannel)
+			atomic.StoreInt32(&f.listening, 1)
+		case pq.ListenerEventReconnected:
+			log.Printf("reconnected to '%v' notifications", changesChannel)
+			atomic.StoreInt32(&f.listening, 1)
+		case pq.ListenerEventDisconnected:
+			log.Printf("lost connection of the notifications listener, falling back to polling: %v", err)
+			atomic.StoreInt32(&f.listening, 0)
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("failed to connect the notifications listener: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	for _, channel := range []string{changesChannel, schemasChannel} {
+		err := listener.Listen(channel)
+		if err != nil {
+			log.Printf("failed to listen to '%v': %v", channel, err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case notification := <-listener.Notify:
+			switch {
+			case notification == nil:
+				// nil is received after reconnection, the poll doubles as the resync then.
+				schemas.clear()
+				f.notify()
+			case notification.Channel == schemasChannel:
+				schemas.invalidate(notification.Extra)
+			default:
+				f.notify()
+			}
+		case <-time.After(listenerPingInterval):
+			go listener.Ping()
+		}
+	}
+}
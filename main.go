@@ -1,8 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"runtime/debug"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -22,19 +28,41 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to connect to the database: %v", err)
 	}
+	keys, err := loadSecretKeys()
+	if err != nil {
+		log.Fatalf("failed to load secret keys: %v", err)
+	}
+	if keys != nil {
+		db = db.Set(secretsSetting, keys)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		tokenCommand(db, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		roleCommand(db, os.Args[2:])
+		return
+	}
 
 	switch len(os.Args) {
 	case 1:
-		run(db, addr)
+		run(db, dbConfig, addr)
 
 	case 2:
 		switch os.Args[1] {
 		case "run":
-			run(db, addr)
+			run(db, dbConfig, addr)
 
 		case "migrate":
 			migrate(db)
 
+		case "reencrypt":
+			err = reencrypt(db)
+			if err != nil {
+				log.Fatalf("failed to reencrypt secrets: %v", err)
+			}
+
 		case "rollback":
 			log.Println("destinnation_migration_id required for rollback")
 			help()
@@ -59,11 +87,22 @@ func help() {
 	Commands:
 		run (default)  just start the service
 		migrate        perform all missing migrations
-		rollback       rollback up to destinnation_migration_id`, os.Args[0])
+		reencrypt      encrypt all secret fields with the current key
+		rollback       rollback up to destinnation_migration_id
+		token create <owner> <ttl> [<scope>...]
+		               create API token, zero ttl means no expiry
+		token revoke <id>
+		               revoke API token
+		role set <name> <rules>
+		               create or replace role with JSON array of rules
+		role bind <principal> <role> [<type glob> <name glob>]
+		               grant role to principal
+		role unbind <id>
+		               remove role binding`, os.Args[0])
 	os.Exit(1)
 }
 
-func run(db *gorm.DB, addr string) {
+func run(db *gorm.DB, dbConfig, addr string) {
 	err := ensureMigration(db)
 	if err != nil {
 		log.Printf("migrations in the database do not match expections: %v", err)
@@ -71,9 +110,58 @@ func run(db *gorm.DB, addr string) {
 		os.Exit(1)
 	}
 
-	r := gin.Default()
-	r.POST("/", newConfigServer(db).handle)
-	err = r.Run(addr)
+	// gin.Default() is not used, its recovery dumps the headers of the request with the tokens into the log.
+	r := gin.New()
+	r.Use(gin.Logger(), recovery)
+	cache := newConfigCache(
+		envInt("TEST_CONFIG_CACHE_SIZE", defaultCacheSize),
+		envDuration("TEST_CONFIG_CACHE_TTL", defaultCacheTTL),
+		envDuration("TEST_CONFIG_CACHE_NEGATIVE_TTL", defaultCacheNegativeTTL),
+	)
+	server := newConfigServer(db, cache)
+	server.identities, err = loadIdentities()
+	if err != nil {
+		log.Printf("failed to load client identities: %v", err)
+		os.Exit(1)
+	}
+	server.metrics = newMetrics()
+	instrumentDB(db, server.metrics)
+	r.Use(server.instrument)
+	// The probes go before the audit and the authentication, so they apply to the routes registered later only.
+	server.registerHealth(r)
+	server.auditLog = newAuditLog(db, envDuration("TEST_CONFIG_AUDIT_RETENTION", defaultAuditRetention))
+	go server.auditLog.run()
+	// The audit goes first to record the requests rejected by the authentication.
+	r.Use(server.audit)
+	switch auth := os.Getenv("TEST_CONFIG_AUTH"); auth {
+	case "", "tokens":
+		r.Use(server.authenticate)
+	case "none":
+		log.Println("authentication is disabled")
+	default:
+		log.Printf("unknown authentication mode '%v'", auth)
+		os.Exit(1)
+	}
+	if token := os.Getenv("TEST_CONFIG_SECRETS_TOKEN"); token != "" {
+		r.Use(secretsAccess(token))
+	}
+	switch mode := os.Getenv("TEST_CONFIG_MODE"); mode {
+	case "", "cache":
+	case "snapshot":
+		server.snapshot, err = newSnapshotStore(db, envDuration("TEST_CONFIG_SNAPSHOT_REFRESH", defaultSnapshotRefresh))
+		if err != nil {
+			log.Printf("failed to load configs snapshot: %v", err)
+			os.Exit(1)
+		}
+		go server.snapshot.follow(server.feed)
+	default:
+		log.Printf("unknown serving mode '%v'", mode)
+		os.Exit(1)
+	}
+	go server.feed.listen(dbConfig, server.schemas)
+	server.register(r)
+	server.metrics.setRoutes(r.Routes())
+	err = serve(r, addr)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
@@ -81,3 +169,126 @@ func run(db *gorm.DB, addr string) {
 		os.Exit(0)
 	}
 }
+
+// serve serves plain HTTP unless the TLS certificate and key are set
+// in TEST_CONFIG_TLS_CERT and TEST_CONFIG_TLS_KEY.
+func serve(r *gin.Engine, addr string) error {
+	cert, key := os.Getenv("TEST_CONFIG_TLS_CERT"), os.Getenv("TEST_CONFIG_TLS_KEY")
+	if cert == "" && key == "" {
+		return r.Run(addr)
+	}
+	if cert == "" || key == "" {
+		return errors.New("both TEST_CONFIG_TLS_CERT and TEST_CONFIG_TLS_KEY must be set")
+	}
+
+	config, err := loadTLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load TLS config: %v", err)
+	}
+	log.Printf("Listening and serving HTTPS on %v", addr)
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   r,
+		TLSConfig: config,
+	}
+	return srv.ListenAndServeTLS(cert, key)
+}
+
+// tokenCommand manages the API tokens: `token create <owner> <ttl> [<scope>...]` or `token revoke <id>`.
+func tokenCommand(db *gorm.DB, args []string) {
+	switch {
+	case len(args) >= 3 && args[0] == "create":
+		ttl, err := time.ParseDuration(args[2])
+		if err != nil {
+			log.Fatalf("invalid token ttl: %v", err)
+		}
+		token, err := createToken(db, args[1], ttl, args[3:])
+		if err != nil {
+			log.Fatalf("failed to create token: %v", err)
+		}
+		// The token is printed once to stdout, it is not logged.
+		fmt.Println(token)
+
+	case len(args) == 2 && args[0] == "revoke":
+		err := revokeToken(db, args[1])
+		if err != nil {
+			log.Fatalf("failed to revoke token: %v", err)
+		}
+		log.Printf("token %v revoked", args[1])
+
+	default:
+		help()
+	}
+}
+
+// roleCommand manages the roles and their bindings:
+// `role set <name> <rules>`, `role bind <principal> <role> [<type glob> <name glob>]` or `role unbind <id>`.
+func roleCommand(db *gorm.DB, args []string) {
+	switch {
+	case len(args) == 3 && args[0] == "set":
+		err := setRole(db, args[1], args[2])
+		if err != nil {
+			log.Fatalf("failed to set role: %v", err)
+		}
+		log.Printf("role '%v' saved", args[1])
+
+	case (len(args) == 3 || len(args) == 5) && args[0] == "bind":
+		typeGlob, nameGlob := "*", "*"
+		if len(args) == 5 {
+			typeGlob, nameGlob = args[3], args[4]
+		}
+		id, err := bindRole(db, args[1], args[2], typeGlob, nameGlob)
+		if err != nil {
+			log.Fatalf("failed to bind role: %v", err)
+		}
+		log.Printf("role '%v' bound to '%v' for %v:%v, binding %v", args[2], args[1], typeGlob, nameGlob, id)
+
+	case len(args) == 2 && args[0] == "unbind":
+		err := unbindRole(db, args[1])
+		if err != nil {
+			log.Fatalf("failed to unbind role: %v", err)
+		}
+		log.Printf("binding %v removed", args[1])
+
+	default:
+		help()
+	}
+}
+
+// envInt returns the value of the integer environment variable or def if it is not set.
+func envInt(name string, def int) int {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		log.Fatalf("invalid value of %v: %v", name, err)
+	}
+	return value
+}
+
+// envDuration returns the value of the duration environment variable or def if it is not set.
+func envDuration(name string, def time.Duration) time.Duration {
+	str := os.Getenv(name)
+	if str == "" {
+		return def
+	}
+	value, err := time.ParseDuration(str)
+	if err != nil {
+		log.Fatalf("invalid value of %v: %v", name, err)
+	}
+	return value
+}
+
+// recovery replies with 500 if the handler panics. Unlike gin.Recovery, it logs only the method
+// and the path of the request along with the stack, so the tokens in the headers are never logged.
+func recovery(c *gin.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic recovered while handling %v %v: %v\n%s", c.Request.Method, c.Request.URL.Path, err, debug.Stack())
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}()
+	c.Next()
+}
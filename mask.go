@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maskedValue replaces the values of the secret fields for the callers not authorized to read them.
+const maskedValue = "****"
+
+// secretsTokenHeader carries the token authorizing the caller to read the secret fields.
+const secretsTokenHeader = "X-Config-Secrets-Token"
+
+// readSecretsKey is the key of the gin context flag allowing the caller to read the secret fields.
+const readSecretsKey = "config:read_secrets"
+
+// schemaCacheTTL is the period the schemas are cached for to classify the secret fields on reads.
+// The schemas changed by other server instances are invalidated by the notifications(see listen),
+// the TTL bounds the delay while the notifications are not received.
+const schemaCacheTTL = 10 * time.Second
+
+// secretsAccess allows the requests passing the token in X-Config-Secrets-Token header to read the secret fields.
+func secretsAccess(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader(secretsTokenHeader)
+		if header != "" && subtle.ConstantTimeCompare([]byte(header), []byte(token)) == 1 {
+			c.Set(readSecretsKey, true)
+		}
+	}
+}
+
+// canReadSecrets checks whether the caller is authorized to read the secret fields of the config
+// by the secrets token or by the secrets scope of the API token.
+func canReadSecrets(c *gin.Context, typ, name string) bool {
+	if c.GetBool(readSecretsKey) {
+		return true
+	}
+	token := requestToken(c)
+	return token != nil && token.allows(accessSecrets, typ, name)
+}
+
+// schemaCache keeps the decoded schema documents by type, nil documents are cached for the types without schemas.
+type schemaCache struct {
+	mu      sync.Mutex
+	entries map[string]schemaCacheEntry
+	// generation is incremented by each invalidation, so the document loaded before
+	// the invalidation is not cached after it.
+	generation uint64
+}
+
+type schemaCacheEntry struct {
+	document interface{}
+	expires  time.Time
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{
+		entries: make(map[string]schemaCacheEntry),
+	}
+}
+
+func (cache *schemaCache) invalidate(typ string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generation++
+	delete(cache.entries, typ)
+}
+
+// clear drops all the cached schemas.
+func (cache *schemaCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generation++
+	cache.entries = make(map[string]schemaCacheEntry)
+}
+
+// schemaDocument returns the decoded schema document of the type through the cache.
+func (s configServer) schemaDocument(typ string) (interface{}, error) {
+	s.schemas.mu.Lock()
+	entry, ok := s.schemas.entries[typ]
+	generation := s.schemas.generation
+	s.schemas.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.document, nil
+	}
+
+	document, err := loadSchemaDocument(s.db, typ)
+	if err != nil {
+		return nil, err
+	}
+	s.schemas.mu.Lock()
+	if generation == s.schemas.generation {
+		s.schemas.entries[typ] = schemaCacheEntry{
+			document: document,
+			expires:  time.Now().Add(schemaCacheTTL),
+		}
+	}
+	s.schemas.mu.Unlock()
+	return document, nil
+}
+
+// maskSecrets replaces the values of the secret fields of the config data with the mask,
+// secrets receives the paths of the masked fields. The data which can not be decoded is not served unmasked.
+func (s configServer) maskSecrets(typ string, data json.RawMessage) (masked json.RawMessage, secrets []string, err error) {
+	schema, err := s.schemaDocument(typ)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var value interface{}
+	err = decodeJSON(data, &value)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err = walkSecrets(value, schema, false, "", func(path string, _ interface{}) (interface{}, error) {
+		secrets = append(secrets, path)
+		return maskedValue, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(secrets) == 0 {
+		return data, nil, nil
+	}
+	sort.Strings(secrets)
+	masked, err = json.Marshal(value)
+	return masked, secrets, err
+}
+
+// replyData replies with the config data masking the secret fields unless the caller is authorized to read them.
+func (s configServer) replyData(c *gin.Context, code int, typ, name string, data json.RawMessage) {
+	if data, ok := s.visibleData(c, typ, name, data); ok {
+		c.JSON(code, data)
+	}
+}
+
+// visibleData returns the data masking the secret fields unless the caller is authorized to read them.
+// It replies with 500 on failure.
+func (s configServer) visibleData(c *gin.Context, typ, name string, data json.RawMessage) (json.RawMessage, bool) {
+	if canReadSecrets(c, typ, name) || data == nil {
+		return data, true
+	}
+	masked, _, err := s.maskSecrets(typ, data)
+	if err != nil {
+		replyDBError(c, "failed to mask secrets", err)
+		return nil, false
+	}
+	return masked, true
+}
+
+// checkMasked ensures that the caller not authorized to read the secret fields does not write the mask into them:
+// the data is likely the masked one the caller has read, so the stored secrets would be overwritten with the mask.
+// It replies with 422 listing the paths of such fields or with 500 if the data can not be checked.
+func (s configServer) checkMasked(c *gin.Context, typ, name string, data json.RawMessage) bool {
+	if canReadSecrets(c, typ, name) {
+		return true
+	}
+	schema, err := s.schemaDocument(typ)
+	if err != nil {
+		replyDBError(c, "failed to load schema", err)
+		return false
+	}
+
+	var value interface{}
+	err = decodeJSON(data, &value)
+	if err != nil {
+		replyDBError(c, "failed to decode config data", err)
+		return false
+	}
+	var masked []string
+	_, err = walkSecrets(value, schema, false, "", func(path string, value interface{}) (interface{}, error) {
+		if value == maskedValue {
+			masked = append(masked, path)
+		}
+		return value, nil
+	})
+	if err != nil {
+		replyDBError(c, "failed to check secrets", err)
+		return false
+	}
+	if len(masked) == 0 {
+		return true
+	}
+
+	sort.Strings(masked)
+	log.Printf("config '%v' with type '%v' rejected: masked values of secret fields %v", name, typ, masked)
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":  "secret fields contain the masked value",
+		"fields": masked,
+	})
+	return false
+}
+
+// replyMetadata serves the metadata view of the config: its key, version and the data with all
+// the secret fields masked regardless of the authorization, along with the paths of the secret fields.
+// refSecrets are the paths of the values already masked as the secret fields of the referenced configs.
+func (s configServer) replyMetadata(c *gin.Context, config *Config, data json.RawMessage, refSecrets []string) {
+	masked, secrets, err := s.maskSecrets(config.Type, data)
+	if err != nil {
+		replyDBError(c, "failed to mask secrets", err)
+		return
+	}
+	secrets = mergePaths(secrets, refSecrets)
+
+	c.JSON(http.StatusOK, gin.H{
+		"type":       config.Type,
+		"name":       config.Name,
+		"version":    config.Version,
+		"updated_at": config.UpdatedAt,
+		"secrets":    secrets,
+		"data":       masked,
+	})
+}
+
+// mergePaths returns the sorted union of the paths, it is never nil.
+func mergePaths(a, b []string) []string {
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, path := range append(append([]string{}, a...), b...) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// durationBuckets are the upper bounds of the duration histograms in seconds.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// unmatchedRoute labels the requests not matching any route, so the random paths do not add the series.
+const unmatchedRoute = "unmatched"
+
+// metricsStartKey is the key of the gorm scope value with the start time of the query.
+const metricsStartKey = "metrics:start"
+
+// metrics collects the request and db counters exposed by /metrics in the Prometheus text format.
+type metrics struct {
+	mu sync.Mutex
+	// routes maps the handler names to the route patterns, the requests are labeled by the patterns.
+	routes    map[string]string
+	requests  map[requestMetric]int64
+	latencies map[routeMetric]*histogram
+	queries   map[string]*histogram
+	dbErrors  map[string]int64
+}
+
+type routeMetric struct {
+	method, route string
+}
+
+type requestMetric struct {
+	routeMetric
+	status int
+}
+
+// histogram counts the observed values by durationBuckets.
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		routes:    make(map[string]string),
+		requests:  make(map[requestMetric]int64),
+		latencies: make(map[routeMetric]*histogram),
+		queries:   make(map[string]*histogram),
+		dbErrors:  make(map[string]int64),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// setRoutes remembers the route patterns of the handlers, it must be called after all the routes are registered.
+func (m *metrics) setRoutes(routes gin.RoutesInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, route := range routes {
+		m.routes[route.Handler] = route.Path
+	}
+}
+
+func (m *metrics) observeRequest(method, handler string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	route, ok := m.routes[handler]
+	if !ok {
+		route = unmatchedRoute
+	}
+	key := routeMetric{method, route}
+	m.requests[requestMetric{key, status}]++
+	h, ok := m.latencies[key]
+	if !ok {
+		h = &histogram{}
+		m.latencies[key] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// observeQuery counts the db query of the operation, the missing records are not the errors.
+func (m *metrics) observeQuery(operation string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.queries[operation]
+	if !ok {
+		h = &histogram{}
+		m.queries[operation] = h
+	}
+	h.observe(duration.Seconds())
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		m.dbErrors[operation]++
+	}
+}
+
+// instrumentDB measures the statements of the queries made through gorm.
+// The callbacks are shared by all the handles derived from db.
+func instrumentDB(db *gorm.DB, m *metrics) {
+	callbacks := db.Callback()
+	instrumentCallbacks(callbacks.Create(), "create", m)
+	instrumentCallbacks(callbacks.Query(), "query", m)
+	instrumentCallbacks(callbacks.RowQuery(), "row_query", m)
+	instrumentCallbacks(callbacks.Update(), "update", m)
+	instrumentCallbacks(callbacks.Delete(), "delete", m)
+}
+
+func instrumentCallbacks(processor *gorm.CallbackProcessor, operation string, m *metrics) {
+	statement := "gorm:" + operation
+	processor.Before(statement).Register("metrics:before_"+operation, func(scope *gorm.Scope) {
+		scope.InstanceSet(metricsStartKey, time.Now())
+	})
+	processor.After(statement).Register("metrics:after_"+operation, func(scope *gorm.Scope) {
+		start, ok := scope.InstanceGet(metricsStartKey)
+		if ok {
+			m.observeQuery(operation, time.Since(start.(time.Time)), scope.DB().Error)
+		}
+	})
+}
+
+// instrument is a gin middleware counting the requests and their durations by the routes.
+func (s configServer) instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	if s.metrics != nil {
+		s.metrics.observeRequest(c.Request.Method, c.HandlerName(), c.Writer.Status(), time.Since(start))
+	}
+}
+
+// handleMetrics replies with the metrics in the Prometheus text format.
+func (s configServer) handleMetrics(c *gin.Context) {
+	if !authorizeMetrics(c) {
+		return
+	}
+	var buf bytes.Buffer
+	w := metricsWriter{&buf}
+	if s.metrics != nil {
+		s.metrics.write(w)
+	}
+
+	hits, misses := atomic.LoadInt64(&s.cache.hits), atomic.LoadInt64(&s.cache.misses)
+	w.header("config_cache_hits_total", "counter", "Lookups served from the config cache.")
+	w.sample("config_cache_hits_total", nil, float64(hits))
+	w.header("config_cache_misses_total", "counter", "Lookups missing the config cache.")
+	w.sample("config_cache_misses_total", nil, float64(misses))
+	w.header("config_cache_hit_ratio", "gauge", "Share of the lookups served from the config cache, NaN before the first lookup.")
+	w.sample("config_cache_hit_ratio", nil, ratio(hits, hits+misses))
+	w.header("config_cache_entries", "gauge", "Number of entries in the config cache.")
+	w.sample("config_cache_entries", nil, float64(s.cache.len()))
+
+	if s.auditLog != nil {
+		w.header("config_audit_dropped_total", "counter", "Audit records dropped for the full buffer.")
+		w.sample("config_audit_dropped_total", nil, float64(atomic.LoadInt64(&s.auditLog.dropped)))
+	}
+
+	var rows int64
+	err := s.db.Model(&Config{}).Count(&rows).Error
+	if err != nil {
+		// The rest of the metrics is still useful, especially while the db is down.
+		log.Printf("failed to count configs: %v", err)
+	} else {
+		w.header("config_configs_rows", "gauge", "Number of rows in the configs table.")
+		w.sample("config_configs_rows", nil, float64(rows))
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+func ratio(part, total int64) float64 {
+	if total == 0 {
+		return math.NaN()
+	}
+	return float64(part) / float64(total)
+}
+
+// write writes the collected metrics, the series are sorted by their labels.
+func (m *metrics) write(w metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := make([]requestMetric, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.routeMetric != b.routeMetric {
+			return a.less(b.routeMetric)
+		}
+		return a.status < b.status
+	})
+	w.header("config_http_requests_total", "counter", "Handled HTTP requests by route and status code.")
+	for _, key := range requests {
+		w.sample("config_http_requests_total", []string{"method", key.method, "route", key.route, "status", strconv.Itoa(key.status)}, float64(m.requests[key]))
+	}
+
+	routes := make([]routeMetric, 0, len(m.latencies))
+	for key := range m.latencies {
+		routes = append(routes, key)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].less(routes[j])
+	})
+	w.header("config_http_request_duration_seconds", "histogram", "Durations of the HTTP requests by route.")
+	for _, key := range routes {
+		w.histogram("config_http_request_duration_seconds", []string{"method", key.method, "route", key.route}, m.latencies[key])
+	}
+
+	operations := make([]string, 0, len(m.queries))
+	for operation := range m.queries {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	w.header("config_db_query_duration_seconds", "histogram", "Durations of the db statements by operation.")
+	for _, operation := range operations {
+		w.histogram("config_db_query_duration_seconds", []string{"operation", operation}, m.queries[operation])
+	}
+	w.header("config_db_errors_total", "counter", "Failed db statements by operation.")
+	for _, operation := range operations {
+		w.sample("config_db_errors_total", []string{"operation", operation}, float64(m.dbErrors[operation]))
+	}
+}
+
+func (r routeMetric) less(other routeMetric) bool {
+	if r.route != other.route {
+		return r.route < other.route
+	}
+	return r.method < other.method
+}
+
+// metricsWriter formats the metrics in the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (w metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// sample writes the value of the series, labels are the pairs of the label names and values.
+func (w metricsWriter) sample(name string, labels []string, value float64) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	if len(pairs) != 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w.w, "%v %v\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (w metricsWriter) histogram(name string, labels []string, h *histogram) {
+	for i, bound := range durationBuckets {
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.counts[i]))
+	}
+	w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.count))
+	w.sample(name+"_sum", labels, h.sum)
+	w.sample(name+"_count", labels, float64(h.count))
+}
@@ -34,8 +34,15 @@ var migrations = []migration.Migration{
 		ID:          "0020_test_config_data",
 		Description: "fills db with the test data",
 		Rerform: func(tx *gorm.DB) error {
+			// Raw insert does not depend on the columns added to Config by the later migrations,
+			// so the secret fields are encrypted here if the keys are configured.
 			for _, conf := range testData {
-				err := tx.Create(&conf).Error
+				data, err := encryptSecrets(tx, conf.Type, conf.Name, conf.Data)
+				if err != nil {
+					return err
+				}
+				err = tx.Exec(`INSERT INTO "configs" ("type", "name", "data") VALUES (?, ?, ?)`,
+					conf.Type, conf.Name, data).Error
 				if err != nil {
 					return err
 				}
@@ -52,6 +59,269 @@ var migrations = []migration.Migration{
 			return nil
 		},
 	},
+	{
+		ID:          "0030_schemas_table",
+		Description: "creates table with schemas of config types",
+		Rerform: func(tx *gorm.DB) error {
+			err := tx.Exec(`
+				CREATE TABLE "schemas" (
+					"type" text PRIMARY KEY,
+					"document" jsonb NOT NULL
+				)`).Error
+			if err != nil {
+				return err
+			}
+			// Schemas are checked against the previously added test data on creation.
+			for _, schema := range testSchemas {
+				err := tx.Create(&schema).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable(&Schema{}).Error
+		},
+	},
+	{
+		ID:          "0040_revisions_table",
+		Description: "creates table with history of config changes",
+		Rerform: func(tx *gorm.DB) error {
+			err := tx.Exec(`
+				CREATE TABLE "revisions" (
+					"type" text,
+					"name" text,
+					"revision" integer,
+					"created_at" timestamp with time zone NOT NULL,
+					"author" text NOT NULL,
+					"old_data" jsonb,
+					"new_data" jsonb,
+					PRIMARY KEY ("type","name","revision")
+				)`).Error
+			if err != nil {
+				return err
+			}
+			// Existing configs get their initial revisions.
+			return tx.Exec(`
+				INSERT INTO "revisions" ("type", "name", "revision", "created_at", "author", "new_data")
+				SELECT "type", "name", 1, now(), 'migration', "data" FROM "configs"`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable(&Revision{}).Error
+		},
+	},
+	{
+		ID:          "0050_configs_updated_at",
+		Description: "adds modification time to configs",
+		Rerform: func(tx *gorm.DB) error {
+			return tx.Exec(`ALTER TABLE "configs" ADD COLUMN "updated_at" timestamp with time zone NOT NULL DEFAULT now()`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Model(&Config{}).DropColumn("updated_at").Error
+		},
+	},
+	{
+		ID:          "0060_configs_version",
+		Description: "adds version counter to configs",
+		Rerform: func(tx *gorm.DB) error {
+			return tx.Exec(`ALTER TABLE "configs" ADD COLUMN "version" integer NOT NULL DEFAULT 1`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Model(&Config{}).DropColumn("version").Error
+		},
+	},
+	{
+		ID:          "0070_revisions_id",
+		Description: "adds global sequence number to revisions",
+		Rerform: func(tx *gorm.DB) error {
+			return tx.Exec(`ALTER TABLE "revisions" ADD COLUMN "id" bigserial UNIQUE`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Model(&Revision{}).DropColumn("id").Error
+		},
+	},
+	{
+		ID:          "0080_configs_notify",
+		Description: "adds trigger notifying about config changes",
+		Rerform: func(tx *gorm.DB) error {
+			err := tx.Exec(`
+			CREATE FUNCTION "notify_config_change"() RETURNS trigger AS $$
+			DECLARE
+				changed "configs";
+			BEGIN
+				IF TG_OP = 'DELETE' THEN
+					changed := OLD;
+				ELSE
+					changed := NEW;
+				END IF;
+				PERFORM pg_notify('` + changesChannel + `', json_build_object(
+					'type', changed."type",
+					'name', changed."name",
+					'version', changed."version",
+					'operation', lower(TG_OP)
+				)::text);
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`
+			CREATE TRIGGER "configs_notify" AFTER INSERT OR UPDATE OR DELETE ON "configs"
+			FOR EACH ROW EXECUTE PROCEDURE "notify_config_change"()`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			err := tx.Exec(`DROP TRIGGER "configs_notify" ON "configs"`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`DROP FUNCTION "notify_config_change"()`).Error
+		},
+	},
+	{
+		ID:          "0090_api_tokens_table",
+		Description: "creates table with hashed API tokens",
+		Rerform: func(tx *gorm.DB) error {
+			return tx.Exec(`
+				CREATE TABLE "api_tokens" (
+					"id" serial PRIMARY KEY,
+					"hash" text NOT NULL UNIQUE,
+					"owner" text NOT NULL,
+					"scopes" text[] NOT NULL,
+					"expires_at" timestamp with time zone,
+					"created_at" timestamp with time zone NOT NULL
+				)`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.DropTable(&APIToken{}).Error
+		},
+	},
+	{
+		ID:          "0100_roles_tables",
+		Description: "creates tables with roles and their bindings to principals",
+		Rerform: func(tx *gorm.DB) error {
+			err := tx.Exec(`
+				CREATE TABLE "roles" (
+					"name" text PRIMARY KEY,
+					"rules" jsonb NOT NULL
+				)`).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Exec(`
+				CREATE TABLE "role_bindings" (
+					"id" serial PRIMARY KEY,
+					"principal" text NOT NULL,
+					"role" text NOT NULL,
+					"type_glob" text NOT NULL,
+					"name_glob" text NOT NULL,
+					"created_at" timestamp with time zone NOT NULL
+				)`).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Exec(`CREATE INDEX "idx_role_bindings_principal" ON "role_bindings" ("principal")`).Error
+			if err != nil {
+				return err
+			}
+			for _, role := range builtinRoles {
+				err := tx.Create(&role).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			err := tx.DropTable(&RoleBinding{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.DropTable(&Role{}).Error
+		},
+	},
+	{
+		ID:          "0110_audit_records_table",
+		Description: "creates append-only table with audit records of requests",
+		Rerform: func(tx *gorm.DB) error {
+			err := tx.Exec(`
+				CREATE TABLE "audit_records" (
+					"id" bigserial PRIMARY KEY,
+					"created_at" timestamp with time zone NOT NULL,
+					"principal" text NOT NULL,
+					"client_ip" text NOT NULL,
+					"method" text NOT NULL,
+					"path" text NOT NULL,
+					"action" text NOT NULL,
+					"type" text NOT NULL,
+					"name" text NOT NULL,
+					"status" integer NOT NULL,
+					"outcome" text NOT NULL
+				)`).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Exec(`CREATE INDEX "idx_audit_records_created_at" ON "audit_records" ("created_at")`).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Exec(`CREATE INDEX "idx_audit_records_config" ON "audit_records" ("type", "name")`).Error
+			if err != nil {
+				return err
+			}
+			// The records may be removed by the retention, but never changed.
+			err = tx.Exec(`
+			CREATE FUNCTION "reject_audit_update"() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'audit records are append-only';
+			END;
+			$$ LANGUAGE plpgsql`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`
+			CREATE TRIGGER "audit_records_append_only" BEFORE UPDATE ON "audit_records"
+			FOR EACH ROW EXECUTE PROCEDURE "reject_audit_update"()`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			err := tx.DropTable(&AuditRecord{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`DROP FUNCTION "reject_audit_update"()`).Error
+		},
+	},
+	{
+		ID:          "0120_schemas_notify",
+		Description: "adds trigger notifying about schema changes",
+		Rerform: func(tx *gorm.DB) error {
+			err := tx.Exec(`
+			CREATE FUNCTION "notify_schema_change"() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP = 'DELETE' THEN
+					PERFORM pg_notify('` + schemasChannel + `', OLD."type");
+				ELSE
+					PERFORM pg_notify('` + schemasChannel + `', NEW."type");
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`
+			CREATE TRIGGER "schemas_notify" AFTER INSERT OR UPDATE OR DELETE ON "schemas"
+			FOR EACH ROW EXECUTE PROCEDURE "notify_schema_change"()`).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			err := tx.Exec(`DROP TRIGGER "schemas_notify" ON "schemas"`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec(`DROP FUNCTION "notify_schema_change"()`).Error
+		},
+	},
 }
 
 func toJsonb(str string) postgres.Jsonb {
@@ -88,8 +358,64 @@ var testData = []Config{
 	},
 }
 
+var testSchemas = []Schema{
+	{
+		Type: "database.postgres",
+		Document: toJsonb(`
+		{
+			"type": "object",
+			"required": ["host", "port", "database", "user", "password"],
+			"additionalProperties": false,
+			"properties": {
+				"host": {"type": "string", "minLength": 1},
+				"port": {"type": "string", "pattern": "^[0-9]+$"},
+				"database": {"type": "string", "minLength": 1},
+				"user": {"type": "string", "minLength": 1},
+				"password": {"type": "string"},
+				"schema": {"type": "string"}
+			}
+		}`),
+	},
+	{
+		Type: "rabbit.log",
+		Document: toJsonb(`
+		{
+			"type": "object",
+			"required": ["host", "port", "virtualhost", "user", "password"],
+			"additionalProperties": false,
+			"properties": {
+				"host": {"type": "string", "minLength": 1},
+				"port": {"type": "string", "pattern": "^[0-9]+$"},
+				"virtualhost": {"type": "string"},
+				"user": {"type": "string", "minLength": 1},
+				"password": {"type": "string"}
+			}
+		}`),
+	},
+}
+
+// builtinRoles are the roles created by the migrations, they may be changed later.
+var builtinRoles = []Role{
+	{
+		Name:  "reader",
+		Rules: toJsonb(`[{"effect": "allow", "actions": ["read"], "type": "*", "name": "*"}]`),
+	},
+	{
+		Name:  "writer",
+		Rules: toJsonb(`[{"effect": "allow", "actions": ["read", "write"], "type": "*", "name": "*"}]`),
+	},
+	{
+		Name:  "secret-reader",
+		Rules: toJsonb(`[{"effect": "allow", "actions": ["read", "secrets"], "type": "*", "name": "*"}]`),
+	},
+	{
+		Name:  "admin",
+		Rules: toJsonb(`[{"effect": "allow", "actions": ["*"], "type": "*", "name": "*"}]`),
+	},
+}
+
 func migrate(db *gorm.DB) {
-	err := migration.Migrate(db, migrations)
+	err := migration.Migrate(db.Set(authorSetting, "migration"), migrations)
 	if err != nil {
 		log.Printf("migration failed: %v", err)
 		os.Exit(1)
@@ -100,7 +426,7 @@ func migrate(db *gorm.DB) {
 }
 
 func rollback(db *gorm.DB, dest string) {
-	err := migration.Rollback(db, migrations, dest)
+	err := migration.Rollback(db.Set(authorSetting, "migration"), migrations, dest)
 	if err != nil {
 		log.Printf("rollback failed: %v", err)
 		os.Exit(1)
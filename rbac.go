@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// accessAdmin allows to explain the access of other principals.
+const accessAdmin = "admin"
+
+// Effects of the role rules, deny overrides any allow.
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// policyCacheTTL is the period the rules of the principals are cached for,
+// it bounds the delay of the role and binding changes.
+const policyCacheTTL = 10 * time.Second
+
+// Role is a named set of rules, it is granted to the principals by the bindings.
+type Role struct {
+	Name  string `gorm:"primary_key"`
+	Rules postgres.Jsonb
+}
+
+// roleRule allows or denies the actions(`*` for all) on the configs which type and name match the globs.
+type roleRule struct {
+	Effect  string   `json:"effect"`
+	Actions []string `json:"actions"`
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+}
+
+// RoleBinding grants the role to the principal, the owner of a token or `cert:<identity>` of a client certificate.
+// The role applies only to the configs matching the globs of the binding.
+type RoleBinding struct {
+	ID        uint   `gorm:"primary_key"`
+	Principal string `gorm:"index"`
+	Role      string
+	TypeGlob  string
+	NameGlob  string
+	CreatedAt time.Time
+}
+
+// boundRule is a rule of the role granted by the binding.
+type boundRule struct {
+	roleRule
+	role    string
+	binding RoleBinding
+}
+
+// parseRules decodes and checks the rules of the role.
+func parseRules(data []byte) ([]roleRule, error) {
+	var rules []roleRule
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("rules must be an array of {effect, actions, type, name}: %v", err)
+	}
+	for i, rule := range rules {
+		if rule.Effect != effectAllow && rule.Effect != effectDeny {
+			return nil, fmt.Errorf("rule %v: unknown effect '%v'", i, rule.Effect)
+		}
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("rule %v: no actions", i)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case accessRead, accessWrite, accessSecrets, accessAdmin, accessMetrics, "*":
+			default:
+				return nil, fmt.Errorf("rule %v: unknown action '%v'", i, action)
+			}
+		}
+		if !validGlob(rule.Type) || !validGlob(rule.Name) {
+			return nil, fmt.Errorf("rule %v: invalid pattern", i)
+		}
+	}
+	return rules, nil
+}
+
+func validGlob(glob string) bool {
+	_, err := path.Match(glob, "")
+	return err == nil && glob != ""
+}
+
+// hasAction checks whether the rule applies to the action. As with the scopes, the write and secrets
+// grants include the read one, while the denials apply only to the listed actions.
+func (r roleRule) hasAction(action string) bool {
+	for _, a := range r.Actions {
+		if a == action || a == "*" {
+			return true
+		}
+		if r.Effect == effectAllow && action == accessRead && (a == accessWrite || a == accessSecrets) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks whether the rule applies to the action on the config within the scope of the binding.
+func (r boundRule) matches(action, typ, name string) bool {
+	return r.hasAction(action) && r.matchesType(typ) && globMatch(r.Name, name) && globMatch(r.binding.NameGlob, name)
+}
+
+func (r boundRule) matchesType(typ string) bool {
+	return globMatch(r.Type, typ) && globMatch(r.binding.TypeGlob, typ)
+}
+
+// coversType checks whether the rule applies to all configs of the type, of all types if typ is empty.
+func (r boundRule) coversType(typ string) bool {
+	return globCovers(r.Type, typ) && globCovers(r.binding.TypeGlob, typ) && r.Name == "*" && r.binding.NameGlob == "*"
+}
+
+func globMatch(glob, str string) bool {
+	match, _ := path.Match(glob, str)
+	return match
+}
+
+// globCovers checks whether the glob matches the string, the empty string stands for any string.
+// Unlike globMatch, it does not take the glob characters of the string for the literal ones.
+func globCovers(glob, str string) bool {
+	if str == "" {
+		return glob == "*"
+	}
+	return globMatch(glob, str)
+}
+
+// loadRules loads the rules of all the roles bound to the principal.
+func loadRules(db *gorm.DB, principal string) ([]boundRule, error) {
+	var bindings []RoleBinding
+	err := db.Where("principal = ?", principal).Order("id").Find(&bindings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var bound []boundRule
+	roles := map[string][]roleRule{}
+	for _, binding := range bindings {
+		rules, ok := roles[binding.Role]
+		if !ok {
+			role := Role{Name: binding.Role}
+			res := db.First(&role)
+			switch {
+			case res.RecordNotFound():
+				// The bindings of the removed roles grant nothing.
+			case res.Error != nil:
+				return nil, res.Error
+			default:
+				rules, err = parseRules(role.Rules.RawMessage)
+				if err != nil {
+					return nil, fmt.Errorf("role '%v': %v", role.Name, err)
+				}
+			}
+			roles[binding.Role] = rules
+		}
+		for _, rule := range rules {
+			bound = append(bound, boundRule{rule, binding.Role, binding})
+		}
+	}
+	return bound, nil
+}
+
+// policyCache keeps the rules of the recently authenticated principals.
+type policyCache struct {
+	mu      sync.Mutex
+	entries map[string]policyCacheEntry
+}
+
+type policyCacheEntry struct {
+	rules   []boundRule
+	expires time.Time
+}
+
+func newPolicyCache() *policyCache {
+	return &policyCache{
+		entries: make(map[string]policyCacheEntry),
+	}
+}
+
+// principalRules returns the rules of the principal through the cache.
+func (s configServer) principalRules(principal string) ([]boundRule, error) {
+	now := time.Now()
+	s.policies.mu.Lock()
+	entry, ok := s.policies.entries[principal]
+	s.policies.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.rules, nil
+	}
+
+	rules, err := loadRules(s.db, principal)
+	if err != nil {
+		return nil, err
+	}
+	s.policies.mu.Lock()
+	s.policies.entries[principal] = policyCacheEntry{
+		rules:   rules,
+		expires: now.Add(policyCacheTTL),
+	}
+	s.policies.mu.Unlock()
+	return rules, nil
+}
+
+// setRole creates or replaces the role.
+func setRole(db *gorm.DB, name string, rules string) error {
+	if name == "" {
+		return errors.New("role name required")
+	}
+	_, err := parseRules([]byte(rules))
+	if err != nil {
+		return err
+	}
+	return db.Save(&Role{Name: name, Rules: toJsonb(rules)}).Error
+}
+
+// bindRole grants the role to the principal for the configs matching the globs.
+func bindRole(db *gorm.DB, principal, role, typeGlob, nameGlob string) (uint, error) {
+	if principal == "" {
+		return 0, errors.New("principal required")
+	}
+	if !validGlob(typeGlob) || !validGlob(nameGlob) {
+		return 0, errors.New("invalid pattern")
+	}
+	res := db.First(&Role{Name: role})
+	switch {
+	case res.RecordNotFound():
+		return 0, fmt.Errorf("role '%v' not found", role)
+	case res.Error != nil:
+		return 0, res.Error
+	}
+
+	binding := RoleBinding{
+		Principal: principal,
+		Role:      role,
+		TypeGlob:  typeGlob,
+		NameGlob:  nameGlob,
+	}
+	err := db.Create(&binding).Error
+	return binding.ID, err
+}
+
+// unbindRole removes the binding by its id.
+func unbindRole(db *gorm.DB, id string) error {
+	res := db.Where("id = ?", id).Delete(&RoleBinding{})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return errors.New("binding not found")
+	}
+	return res.Error
+}
+
+// explainedRule describes the rule considered by the explanation.
+type explainedRule struct {
+	Role     string `json:"role"`
+	Binding  uint   `json:"binding"`
+	TypeGlob string `json:"binding_type"`
+	NameGlob string `json:"binding_name"`
+	roleRule
+	Matched bool `json:"matched"`
+}
+
+// explainedScope describes the scope of the token considered by the explanation.
+type explainedScope struct {
+	Scope   string `json:"scope"`
+	Matched bool   `json:"matched"`
+}
+
+// handleExplain tells whether the principal may perform the action on the config and why:
+// `GET /explain?principal=...&action=...&type=...&name=...`.
+// The caller is explained if the principal is omitted, it includes the scopes of the caller's token or certificate.
+// Explaining other principals requires the admin access to the config, their scopes are loaded by principalToken.
+func (s configServer) handleExplain(c *gin.Context) {
+	action, typ, name := c.DefaultQuery("action", accessRead), c.Query("type"), c.Query("name")
+	auditConfig(c, "explain", typ, name)
+	if typ == "" || name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "empty type or name",
+		})
+		return
+	}
+	switch action {
+	case accessRead, accessWrite, accessSecrets, accessAdmin, accessMetrics:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unknown action",
+		})
+		return
+	}
+
+	token := requestToken(c)
+	principal := c.Query("principal")
+	switch {
+	case principal == "" && token == nil:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "principal required",
+		})
+		return
+	case principal == "" || (token != nil && principal == token.Owner):
+		principal = token.Owner
+	case !authorize(c, accessAdmin, typ, name):
+		return
+	default:
+		var err error
+		token, err = s.principalToken(principal)
+		if err != nil {
+			replyDBError(c, "failed to load principal", err)
+			return
+		}
+	}
+
+	// The decision is made the same way as for the requests, the rest only explains it.
+	allowed := token.allows(action, typ, name)
+	reason, explained := "no rule or scope allows the action", false
+	explainedScopes := []explainedScope{}
+	for _, sc := range token.scopes {
+		matched := sc.allows(action, typ, name)
+		explainedScopes = append(explainedScopes, explainedScope{
+			Scope:   sc.access + ":" + sc.typeGlob + ":" + sc.nameGlob,
+			Matched: matched,
+		})
+		if matched && allowed && !explained {
+			reason, explained = "allowed by scope "+explainedScopes[len(explainedScopes)-1].Scope, true
+		}
+	}
+	explainedRules := []explainedRule{}
+	for _, rule := range token.rules {
+		matched := rule.matches(action, typ, name)
+		explainedRules = append(explainedRules, explainedRule{
+			Role:     rule.role,
+			Binding:  rule.binding.ID,
+			TypeGlob: rule.binding.TypeGlob,
+			NameGlob: rule.binding.NameGlob,
+			roleRule: rule.roleRule,
+			Matched:  matched,
+		})
+		// The first deny explains the refusal, the first allow explains the grant not given by the scopes.
+		if !matched || explained || allowed != (rule.Effect == effectAllow) {
+			continue
+		}
+		explained = true
+		verb := "allowed"
+		if !allowed {
+			verb = "denied"
+		}
+		reason = fmt.Sprintf("%v by role '%v' of binding %v", verb, rule.role, rule.binding.ID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"principal": principal,
+		"action":    action,
+		"type":      typ,
+		"name":      name,
+		"allowed":   allowed,
+		"reason":    reason,
+		"rules":     explainedRules,
+		"scopes":    explainedScopes,
+	})
+}
+
+// principalToken returns the token with the rules of the principal and the scopes of all its unexpired tokens
+// or of its certificate identity, it allows what any credential of the principal allows.
+func (s configServer) principalToken(principal string) (*APIToken, error) {
+	var tokens []APIToken
+	err := s.db.Where("owner = ? AND (expires_at IS NULL OR expires_at > ?)", principal, time.Now()).Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	token := &APIToken{Owner: principal}
+	for _, t := range tokens {
+		token.scopes = append(token.scopes, t.scopes...)
+	}
+	if identity := strings.TrimPrefix(principal, "cert:"); identity != principal {
+		token.scopes = append(token.scopes, s.identities[identity]...)
+	}
+	token.rules, err = s.principalRules(principal)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
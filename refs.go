@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRefDepth limits the length of the reference chains.
+const maxRefDepth = 8
+
+// refPattern matches the references `${type/name#key}` in the strings of the config data.
+// The key is a dotted path in the data of the referenced config, the whole data is referenced without it.
+// `$${` escapes the reference.
+var refPattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// refError describes the reference which can not be resolved.
+type refError struct {
+	ref string
+	msg string
+}
+
+func (e *refError) Error() string {
+	return fmt.Sprintf("reference ${%v}: %v", e.ref, e.msg)
+}
+
+// hasRefs is a cheap check whether the data may contain references.
+func hasRefs(data []byte) bool {
+	return bytes.Contains(data, []byte("${"))
+}
+
+// maskedSecret is the masked value of a secret field of a referenced config.
+// The strings embedding it are masked entirely.
+type maskedSecret string
+
+// secretMask replaces the values of the secret fields of the referenced config data with maskedSecret
+// unless the caller may read them.
+type secretMask func(typ, name string, data map[string]interface{}) error
+
+// resolveData returns the data of the config merged with its layers and with the references replaced
+// by the referenced values, abstract is true if the config is marked as abstract.
+func resolveData(config *Config, load configLoader) (data json.RawMessage, abstract bool, err error) {
+	data, abstract, _, err = resolveMasked(config, load, nil)
+	return data, abstract, err
+}
+
+// resolveMasked is resolveData masking the secret fields of the referenced configs and of the layers with mask,
+// secrets are the paths of the masked values in the resolved data. Nil mask masks nothing.
+func resolveMasked(config *Config, load configLoader, mask secretMask) (data json.RawMessage, abstract bool, secrets []string, err error) {
+	if !hasLayers(config.Data.RawMessage) && !hasRefs(config.Data.RawMessage) {
+		return config.Data.RawMessage, false, nil, nil
+	}
+
+	r := &refResolver{
+		load:     load,
+		mask:     mask,
+		resolved: map[string]interface{}{},
+	}
+	value, abstract, err := r.resolve(config)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	data, err = json.Marshal(value)
+	return data, abstract, maskedPaths(value, ""), err
+}
+
+// maskedPaths returns the paths of the masked values in the same form as walkSecrets.
+func maskedPaths(value interface{}, path string) []string {
+	var paths []string
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			paths = append(paths, maskedPaths(item, keyPath)...)
+		}
+	case []interface{}:
+		for i, item := range value {
+			paths = append(paths, maskedPaths(item, fmt.Sprintf("%v[%v]", path, i))...)
+		}
+	case maskedSecret:
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// refResolver resolves the references of a single config.
+type refResolver struct {
+	load configLoader
+	// mask masks the secret fields of the referenced configs, it may be nil.
+	mask secretMask
+	// stack holds the chain of the configs being resolved as `type/name`.
+	stack []string
+	// resolved caches the data of the referenced configs.
+	resolved map[string]interface{}
+}
+
+func (r *refResolver) resolve(config *Config) (value map[string]interface{}, abstract bool, err error) {
+	layers, err := resolveLayers(config, r.load)
+	if err == nil {
+		err = maskLayers(config.Type, layers, r.mask)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	value = mergeLayers(layers, nil)
+
+	r.stack = append(r.stack, config.Type+"/"+config.Name)
+	defer func() {
+		r.stack = r.stack[:len(r.stack)-1]
+	}()
+	for key, item := range value {
+		value[key], err = r.substitute(item)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return value, layers[len(layers)-1].isAbstract(), nil
+}
+
+// substitute replaces the references in the strings of the value.
+func (r *refResolver) substitute(value interface{}) (interface{}, error) {
+	var err error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key], err = r.substitute(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i], err = r.substitute(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case string:
+		// The string consisting of a single reference is replaced with the referenced value of any type.
+		if match := refPattern.FindStringSubmatch(value); match != nil && match[0] == value && value[1] != '$' {
+			return r.lookup(match[1])
+		}
+
+		var result string
+		masked := false
+		result = refPattern.ReplaceAllStringFunc(value, func(match string) string {
+			if err != nil {
+				return ""
+			}
+			if strings.HasPrefix(match, "$$") {
+				return match[1:]
+			}
+
+			ref := match[2 : len(match)-1]
+			var referenced interface{}
+			referenced, err = r.lookup(ref)
+			switch referenced := referenced.(type) {
+			case maskedSecret:
+				masked = true
+				return string(referenced)
+			case string:
+				return referenced
+			case json.Number, bool:
+				return fmt.Sprint(referenced)
+			}
+			if err == nil {
+				err = &refError{ref, "only strings, numbers and booleans may be embedded into strings"}
+			}
+			return ""
+		})
+		if masked && err == nil {
+			return maskedSecret(maskedValue), nil
+		}
+		return result, err
+	}
+	return value, nil
+}
+
+// lookup returns the value referenced by `type/name#key`.
+func (r *refResolver) lookup(ref string) (interface{}, error) {
+	target, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		target, key = ref[:i], ref[i+1:]
+	}
+	i := strings.Index(target, "/")
+	if i <= 0 || i == len(target)-1 {
+		return nil, &refError{ref, "invalid reference, `type/name#key` expected"}
+	}
+
+	data, ok := r.resolved[target]
+	if !ok {
+		for _, config := range r.stack {
+			if config == target {
+				return nil, &refError{ref, "references form a cycle: " + strings.Join(append(r.stack, target), " -> ")}
+			}
+		}
+		if len(r.stack) >= maxRefDepth {
+			return nil, &refError{ref, fmt.Sprintf("references are nested deeper than %v", maxRefDepth)}
+		}
+
+		config, err := r.load(target[:i], target[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return nil, &refError{ref, "referenced config does not exist"}
+		}
+		var value map[string]interface{}
+		value, _, err = r.resolve(config)
+		if err == nil && r.mask != nil {
+			err = r.mask(config.Type, config.Name, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = value
+		r.resolved[target] = data
+	}
+
+	value := data
+	if key == "" {
+		return value, nil
+	}
+	for _, part := range strings.Split(key, ".") {
+		obj, _ := value.(map[string]interface{})
+		value, ok = obj[part]
+		if !ok {
+			return nil, &refError{ref, "referenced key does not exist"}
+		}
+	}
+	return value, nil
+}
+
+// resolvedData returns the data of the config to be served, merged with its layers and with the references resolved.
+// The secret fields of the referenced configs are masked unless the caller may read them, or always if maskAll is set,
+// secrets are the paths of the masked values. It replies with an error on failure.
+func (s configServer) resolvedData(c *gin.Context, config *Config, maskAll bool) (data json.RawMessage, secrets []string, ok bool) {
+	data, _, secrets, err := resolveMasked(config, s.getConfig, s.referenceMask(c, maskAll))
+	if err != nil {
+		replyResolveError(c, config.Type, config.Name, err)
+		return nil, nil, false
+	}
+	return data, secrets, true
+}
+
+// referenceMask masks the secret fields of the referenced configs and of the layers the caller can not read,
+// or all of them if maskAll is set.
+func (s configServer) referenceMask(c *gin.Context, maskAll bool) secretMask {
+	return func(typ, name string, data map[string]interface{}) error {
+		if !maskAll && canReadSecrets(c, typ, name) {
+			return nil
+		}
+		schema, err := s.schemaDocument(typ)
+		if err != nil {
+			return err
+		}
+		_, err = walkSecrets(data, schema, false, "", func(string, interface{}) (interface{}, error) {
+			return maskedSecret(maskedValue), nil
+		})
+		return err
+	}
+}
+
+// replyResolveError replies with 422 for the unresolvable references and with 500 for the other errors.
+func replyResolveError(c *gin.Context, typ, name string, err error) {
+	switch err := err.(type) {
+	case *refError:
+		log.Printf("failed to resolve config '%v' with type '%v': %v", name, typ, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":     err.msg,
+			"reference": "${" + err.ref + "}",
+		})
+	case layerError:
+		log.Printf("failed to resolve layers of config '%v' with type '%v': %v", name, typ, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		replyDBError(c, "failed to load referenced configs", err)
+	}
+}
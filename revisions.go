@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// authorSetting is a gorm setting with the author of the changes to be recorded in revisions.
+const authorSetting = "config:author"
+
+// revisionsLock is the key of Postgres advisory lock taken by the writers of revisions.
+const revisionsLock = 0x7265766973696f6e
+
+// authorHeader allows clients to introduce themselves as authors of the changes.
+const authorHeader = "X-Config-Author"
+
+// Revision is an immutable record of a single change of the config.
+// Revisions of each config are numbered from 1, the numbering continues after the config removal.
+type Revision struct {
+	// Global sequence number of the change, see recordRevision.
+	ID        int64     `gorm:"auto_increment" json:"id"`
+	Type      string    `gorm:"primary_key" json:"-"`
+	Name      string    `gorm:"primary_key" json:"-"`
+	Revision  int       `gorm:"primary_key;auto_increment:false" json:"revision"`
+	CreatedAt time.Time `json:"created_at"`
+	Author    string    `json:"author"`
+	// Data before the change, nil for the creation.
+	OldData *postgres.Jsonb `json:"old_data"`
+	// Data after the change, nil for the removal.
+	NewData *postgres.Jsonb `json:"new_data"`
+}
+
+// loadPrevious locks the current row of the config till the end of the transaction
+// and keeps it for the revision record.
+func (c *Config) loadPrevious(tx *gorm.DB) error {
+	current := Config{
+		Type: c.Type,
+		Name: c.Name,
+	}
+	res := tx.Set("gorm:query_option", "FOR UPDATE").First(&current)
+	switch {
+	case res.RecordNotFound():
+		c.previous = nil
+	case res.Error != nil:
+		return fmt.Errorf("failed to load previous config data: %v", res.Error)
+	default:
+		c.previous = &current
+	}
+	return nil
+}
+
+// recordRevision saves the change of the config from the data loaded by loadPrevious to newData.
+func (c *Config) recordRevision(tx *gorm.DB, newData *postgres.Jsonb) error {
+	// Configs are written by the migrations before the revisions table is created.
+	if !tx.HasTable(&Revision{}) {
+		return nil
+	}
+
+	// The lock serializes the writers till the commit, so the ids of the revisions
+	// are assigned in the commit order and the change feed can rely on them.
+	err := tx.Exec("SELECT pg_advisory_xact_lock(?)", revisionsLock).Error
+	if err != nil {
+		return fmt.Errorf("failed to lock revisions: %v", err)
+	}
+
+	var last int
+	err = tx.Model(&Revision{}).
+		Where("type = ? AND name = ?", c.Type, c.Name).
+		Select("COALESCE(MAX(revision), 0)").
+		Row().Scan(&last)
+	if err != nil {
+		return fmt.Errorf("failed to load last revision: %v", err)
+	}
+
+	author, _ := tx.Get(authorSetting)
+	if author == nil {
+		author = "unknown"
+	}
+
+	revision := Revision{
+		Type:     c.Type,
+		Name:     c.Name,
+		Revision: last + 1,
+		Author:   fmt.Sprint(author),
+		NewData:  newData,
+	}
+	if c.previous != nil {
+		revision.OldData = &c.previous.Data
+	}
+	return tx.Create(&revision).Error
+}
+
+// writer returns the db handle recording the author of the request in revisions.
+// The owner of the API token is the author if the request is authenticated.
+func (s configServer) writer(c *gin.Context) *gorm.DB {
+	author := c.GetHeader(authorHeader)
+	if token := requestToken(c); token != nil {
+		author = token.Owner
+	} else if author == "" {
+		author = clientAddr(c)
+	}
+	return s.db.Set(authorSetting, author)
+}
+
+// lookupRevision replies with the data of the config as of the revision or the moment
+// passed in the `revision` or the `at`(RFC 3339) query parameter.
+func (s configServer) lookupRevision(c *gin.Context, typ, name string) {
+	query := s.db.Where("type = ? AND name = ?", typ, name)
+	if str := c.Query("revision"); str != "" {
+		revision, err := strconv.Atoi(str)
+		if err != nil {
+			log.Printf("invalid revision '%v'", str)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid revision",
+			})
+			return
+		}
+		query = query.Where("revision = ?", revision)
+	} else {
+		at, err := time.Parse(time.RFC3339, c.Query("at"))
+		if err != nil {
+			log.Printf("invalid revision time '%v': %v", c.Query("at"), err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid time",
+			})
+			return
+		}
+		query = query.Where("created_at <= ?", at).Order("revision DESC")
+	}
+
+	var revision Revision
+	res := query.First(&revision)
+	switch {
+	case res.RecordNotFound():
+		replyNotFound(c, typ, name)
+	case res.Error != nil:
+		replyDBError(c, "failed to load revision", res.Error)
+	case revision.NewData == nil:
+		// The config was removed at that moment.
+		replyNotFound(c, typ, name)
+	default:
+		s.replyData(c, http.StatusOK, typ, name, revision.NewData.RawMessage)
+	}
+}
+
+// handleRevisions lists revisions of the config, the newest ones go first:
+// `GET /configs/:type/:name/revisions?cursor=...&limit=...`.
+func (s configServer) handleRevisions(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessRead, typ, name) {
+		return
+	}
+	limit, cursor, ok := pageParams(c, 1)
+	if !ok {
+		return
+	}
+
+	query := s.db.Where("type = ? AND name = ?", typ, name)
+	if cursor != nil {
+		last, err := strconv.Atoi(cursor[0])
+		if err != nil {
+			log.Printf("invalid revisions cursor: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid cursor",
+			})
+			return
+		}
+		query = query.Where("revision < ?", last)
+	}
+
+	var reply listReply
+	revisions := []Revision{}
+	err := query.Order("revision DESC").Limit(limit + 1).Find(&revisions).Error
+	if err != nil {
+		replyDBError(c, "failed to list revisions", err)
+		return
+	}
+
+	if len(revisions) > limit {
+		revisions = revisions[:limit]
+		reply.Next = encodeCursor(strconv.Itoa(revisions[limit-1].Revision))
+	}
+	for i := range revisions {
+		if !s.maskRevision(c, &revisions[i]) {
+			return
+		}
+	}
+	reply.Items = revisions
+	c.JSON(http.StatusOK, reply)
+}
+
+// handleRevision replies with the single revision: `GET /configs/:type/:name/revisions/:revision`.
+func (s configServer) handleRevision(c *gin.Context) {
+	if !authorize(c, accessRead, c.Param("type"), c.Param("name")) {
+		return
+	}
+	revision, ok := s.loadRevision(c)
+	if !ok || !s.maskRevision(c, &revision) {
+		return
+	}
+	c.JSON(http.StatusOK, revision)
+}
+
+// maskRevision masks the secret fields of the revision data unless the caller is authorized to read them.
+// It replies with 500 on failure.
+func (s configServer) maskRevision(c *gin.Context, revision *Revision) bool {
+	for _, data := range []*postgres.Jsonb{revision.OldData, revision.NewData} {
+		if data == nil {
+			continue
+		}
+		visible, ok := s.visibleData(c, revision.Type, revision.Name, data.RawMessage)
+		if !ok {
+			return false
+		}
+		data.RawMessage = visible
+	}
+	return true
+}
+
+// handleRestore makes the data of the revision current, it is recorded as a new revision.
+// Restoring the revision of the removal deletes the config.
+// Unlike the other updates, it does not require a precondition, but checks it if passed.
+func (s configServer) handleRestore(c *gin.Context) {
+	if !authorize(c, accessWrite, c.Param("type"), c.Param("name")) {
+		return
+	}
+	revision, ok := s.loadRevision(c)
+	if !ok {
+		return
+	}
+	typ, name := revision.Type, revision.Name
+	if revision.NewData != nil && !s.authorizeDependencies(c, typ, name, revision.NewData.RawMessage) {
+		return
+	}
+
+	tx := s.writer(c).Begin()
+	config, ok := lockConfig(c, tx, typ, name)
+	if !ok || !s.checkPrecondition(c, config, false) {
+		tx.Rollback()
+		return
+	}
+	if config == nil {
+		config = &Config{
+			Type: typ,
+			Name: name,
+		}
+	}
+
+	var err error
+	if revision.NewData == nil {
+		err = tx.Delete(config).Error
+	} else {
+		config.Data = *revision.NewData
+		err = tx.Save(config).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		replySaveError(c, typ, name, err)
+		return
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		replyDBError(c, "failed to commit restored config", err)
+		return
+	}
+	s.changed(typ, name)
+
+	if revision.NewData == nil {
+		log.Printf("config '%v' with type '%v' restored to removal at revision %v", name, typ, revision.Revision)
+		c.Status(http.StatusNoContent)
+		return
+	}
+	log.Printf("config '%v' with type '%v' restored to revision %v", name, typ, revision.Revision)
+	s.setVersion(c, config)
+	s.replyData(c, http.StatusOK, typ, name, config.Data.RawMessage)
+}
+
+// loadRevision loads the revision addressed by the path parameters.
+// It replies with an error if the revision cannot be loaded.
+func (s configServer) loadRevision(c *gin.Context) (Revision, bool) {
+	typ, name, ok := configKey(c)
+	if !ok {
+		return Revision{}, false
+	}
+	number, err := strconv.Atoi(c.Param("revision"))
+	// Zero value of the primary key field would be ignored in the query.
+	if err != nil || number <= 0 {
+		log.Printf("invalid revision '%v'", c.Param("revision"))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid revision",
+		})
+		return Revision{}, false
+	}
+
+	revision := Revision{
+		Type:     typ,
+		Name:     name,
+		Revision: number,
+	}
+	res := s.db.First(&revision)
+	switch {
+	case res.RecordNotFound():
+		log.Printf("revision %v of config '%v' with type '%v' not found", number, name, typ)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "record not found",
+		})
+		return Revision{}, false
+	case res.Error != nil:
+		replyDBError(c, "failed to load revision", res.Error)
+		return Revision{}, false
+	}
+	return revision, true
+}
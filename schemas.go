@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/betrok/test-config-server/jsonschema"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// Schema holds JSON Schema document for the data of all configs with the given type.
+// Types without a schema accept any JSON object.
+type Schema struct {
+	Type     string `gorm:"primary_key"`
+	Document postgres.Jsonb
+
+	// Whether the change of the schema changes the secret marks, so the stored secrets are rewritten.
+	marksChanged bool
+}
+
+// BeforeSave is a gorm hook ensuring that the schema document is valid
+// and all existing configs of the type match it.
+func (s *Schema) BeforeSave(tx *gorm.DB) error {
+	schema, err := jsonschema.Parse(s.Document.RawMessage)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	err = decodeJSON(s.Document.RawMessage, &document)
+	if err != nil {
+		return err
+	}
+	previous, err := loadSchemaDocument(tx, s.Type)
+	if err != nil {
+		return err
+	}
+	s.marksChanged = !reflect.DeepEqual(secretMarks(previous, ""), secretMarks(document, ""))
+
+	var configs []Config
+	err = tx.Where("type = ?", s.Type).Find(&configs).Error
+	if err != nil {
+		return err
+	}
+
+	mismatches := schemaMismatchError{}
+	for _, config := range configs {
+		data, abstract, err := resolveData(&config, txLoader(tx))
+		if err == nil && abstract {
+			continue
+		}
+		if err == nil {
+			err = schema.Validate(data)
+		}
+		if err != nil {
+			mismatches[config.Name] = violations(err)
+		}
+	}
+	if len(mismatches) != 0 {
+		return mismatches
+	}
+	return nil
+}
+
+// AfterSave encrypts the fields which have become secret and decrypts the ones which are not secret anymore.
+func (s *Schema) AfterSave(tx *gorm.DB) error {
+	if !s.marksChanged {
+		return nil
+	}
+	return rewriteSecrets(tx, s.Type)
+}
+
+// BeforeDelete checks whether the removed schema marks any fields as secret.
+func (s *Schema) BeforeDelete(tx *gorm.DB) error {
+	previous, err := loadSchemaDocument(tx, s.Type)
+	s.marksChanged = len(secretMarks(previous, "")) != 0
+	return err
+}
+
+// AfterDelete decrypts the fields which were secret only by the marks of the removed schema.
+func (s *Schema) AfterDelete(tx *gorm.DB) error {
+	return s.AfterSave(tx)
+}
+
+// secretMarks returns the sorted paths of the properties marked as secret in the schema document,
+// the items of arrays are denoted by `[]`.
+func secretMarks(schema interface{}, path string) []string {
+	node, _ := schema.(map[string]interface{})
+	var marks []string
+	properties, _ := node["properties"].(map[string]interface{})
+	for key, property := range properties {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		if node, _ := property.(map[string]interface{}); node["secret"] == true {
+			marks = append(marks, keyPath)
+		}
+		marks = append(marks, secretMarks(property, keyPath)...)
+	}
+	if items, ok := node["items"]; ok {
+		marks = append(marks, secretMarks(items, path+"[]")...)
+	}
+	sort.Strings(marks)
+	return marks
+}
+
+// validate checks the data merged with its layers and with the references resolved against the schema
+// of the config type. The layers and the references must be resolvable,
+// the abstract configs are not checked against the schema.
+func (c *Config) validate(tx *gorm.DB) error {
+	err := checkObject(c.Data.RawMessage)
+	if err == nil {
+		err = checkPlaintext(c.Data.RawMessage)
+	}
+	if err != nil {
+		return dataError(err.Error())
+	}
+	data, abstract, err := resolveData(c, txLoader(tx))
+	if err != nil || abstract {
+		return err
+	}
+
+	stored, err := shareSchema(tx, c.Type)
+	if err != nil || stored == nil {
+		return err
+	}
+
+	schema, err := jsonschema.Parse(stored.Document.RawMessage)
+	if err != nil {
+		return fmt.Errorf("invalid schema stored for type '%v': %v", c.Type, err)
+	}
+	return schema.Validate(data)
+}
+
+// loadSchema returns the stored schema of the type, it is nil if the type has no schema.
+// The schemas table is created by a later migration than the configs one,
+// so the configs the earlier migrations write and read have no schema.
+func loadSchema(tx *gorm.DB, typ string) (*Schema, error) {
+	if !tx.HasTable(&Schema{}) {
+		return nil, nil
+	}
+
+	stored := &Schema{Type: typ}
+	res := tx.First(stored)
+	switch {
+	case res.RecordNotFound():
+		return nil, nil
+	case res.Error != nil:
+		return nil, fmt.Errorf("failed to load schema: %v", res.Error)
+	}
+	return stored, nil
+}
+
+// schemaLockClass is the first key of the Postgres advisory locks of the types, the second one is the hash of the type.
+// The schema writers take the lock exclusively and the config writers share it, so the configs are not validated
+// against the schema being replaced, nor written without a schema while it is being created.
+const schemaLockClass = 0x736368
+
+// lockSchemaType takes the advisory lock of the type till the end of the transaction.
+func lockSchemaType(tx *gorm.DB, typ string, shared bool) error {
+	lock := "pg_advisory_xact_lock"
+	if shared {
+		lock += "_shared"
+	}
+	err := tx.Exec("SELECT "+lock+"(?, hashtext(?))", schemaLockClass, typ).Error
+	if err != nil {
+		return fmt.Errorf("failed to lock schema: %v", err)
+	}
+	return nil
+}
+
+// shareSchema loads the schema of the type for the config write, the schema can not be changed
+// till the end of the transaction then.
+func shareSchema(tx *gorm.DB, typ string) (*Schema, error) {
+	if !tx.HasTable(&Schema{}) {
+		return nil, nil
+	}
+	err := lockSchemaType(tx, typ, true)
+	if err != nil {
+		return nil, err
+	}
+	return loadSchema(tx.Set("gorm:query_option", "FOR SHARE"), typ)
+}
+
+// schemaMismatchError maps names of the configs, which do not match a new schema, to their violations.
+type schemaMismatchError map[string][]string
+
+func (e schemaMismatchError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "existing configs do not match the schema: " + strings.Join(names, ", ")
+}
+
+// violations returns the descriptions of the schema violations or the error message itself.
+func violations(err error) []string {
+	if verr, ok := err.(*jsonschema.ValidationError); ok {
+		return verr.Strings()
+	}
+	return []string{err.Error()}
+}
+
+// handleGetSchema replies with the schema document of the type.
+func (s configServer) handleGetSchema(c *gin.Context) {
+	schema := Schema{Type: c.Param("type")}
+	if !allowedType(c, accessRead, schema.Type) {
+		replyForbidden(c, accessRead, schema.Type, "*")
+		return
+	}
+	res := s.db.First(&schema)
+	switch {
+	case res.RecordNotFound():
+		log.Printf("schema for type '%v' not found", schema.Type)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "record not found",
+		})
+	case res.Error != nil:
+		replyDBError(c, "failed to load schema", res.Error)
+	default:
+		c.JSON(http.StatusOK, schema.Document.RawMessage)
+	}
+}
+
+// handlePutSchema creates or replaces the schema of the type.
+// It replies with 422 if any existing config of the type does not match the new schema.
+// The schema affects all configs of the type, so the write access to all of them is required,
+// and the secrets access as well if the schema removes the secret marks(see authorizeMarks).
+func (s configServer) handlePutSchema(c *gin.Context) {
+	typ := c.Param("type")
+	if !authorizeType(c, accessWrite, typ) {
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Printf("failed to read request body: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return
+	}
+
+	_, err = jsonschema.Parse(body)
+	if err != nil {
+		log.Printf("invalid schema for type '%v': %v", typ, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// The type lock serializes the schema writes with each other and with the config writes,
+	// the creations included. The row lock guards against the writers not taking it.
+	tx := s.writer(c).Begin()
+	err = lockSchemaType(tx, typ, false)
+	if err != nil {
+		tx.Rollback()
+		replyDBError(c, "failed to save schema", err)
+		return
+	}
+	schema := Schema{Type: typ}
+	res := tx.Set("gorm:query_option", "FOR UPDATE").First(&schema)
+	if res.Error != nil && !res.RecordNotFound() {
+		tx.Rollback()
+		replyDBError(c, "failed to load schema", res.Error)
+		return
+	}
+	created := res.RecordNotFound()
+	if !created && !s.authorizeMarks(c, typ, schema.Document.RawMessage, body) {
+		tx.Rollback()
+		return
+	}
+
+	schema.Document = postgres.Jsonb{RawMessage: json.RawMessage(body)}
+	if created {
+		err = tx.Create(&schema).Error
+	} else {
+		err = tx.Save(&schema).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		if mismatches, ok := err.(schemaMismatchError); ok {
+			log.Printf("schema for type '%v' rejected: %v", typ, err)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":      "existing configs do not match the schema",
+				"violations": mismatches,
+			})
+			return
+		}
+		if isUniqueViolation(err) {
+			log.Printf("schema for type '%v' created concurrently", typ)
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "schema changed concurrently",
+			})
+			return
+		}
+		replyDBError(c, "failed to save schema", err)
+		return
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		replyDBError(c, "failed to commit schema", err)
+		return
+	}
+	s.schemas.invalidate(typ)
+
+	if created {
+		log.Printf("schema for type '%v' created", typ)
+		c.Status(http.StatusCreated)
+	} else {
+		log.Printf("schema for type '%v' replaced", typ)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// authorizeMarks ensures that the caller may read the secrets of all configs of the type if the new schema
+// removes any secret mark of the previous one: the fields which are not secret anymore are stored
+// and served in plaintext. It replies with 403 otherwise and with 500 if the schemas can not be decoded.
+func (s configServer) authorizeMarks(c *gin.Context, typ string, previous, next []byte) bool {
+	var previousDocument, nextDocument interface{}
+	err := decodeJSON(previous, &previousDocument)
+	if err == nil {
+		err = decodeJSON(next, &nextDocument)
+	}
+	if err != nil {
+		replyDBError(c, "failed to decode schema", err)
+		return false
+	}
+
+	kept := map[string]bool{}
+	for _, mark := range secretMarks(nextDocument, "") {
+		kept[mark] = true
+	}
+	for _, mark := range secretMarks(previousDocument, "") {
+		if !kept[mark] {
+			return authorizeType(c, accessSecrets, typ)
+		}
+	}
+	return true
+}
+
+// handleDeleteSchema removes the schema, configs of the type will accept any data.
+// The removal drops the secret marks, so the secrets access to all configs of the type is required as well.
+func (s configServer) handleDeleteSchema(c *gin.Context) {
+	typ := c.Param("type")
+	if !authorizeType(c, accessWrite, typ) || !authorizeType(c, accessSecrets, typ) {
+		return
+	}
+
+	// The configs being written are validated against the schema till they are committed.
+	tx := s.writer(c).Begin()
+	err := lockSchemaType(tx, typ, false)
+	if err != nil {
+		tx.Rollback()
+		replyDBError(c, "failed to delete schema", err)
+		return
+	}
+	res := tx.Delete(&Schema{Type: typ})
+	switch {
+	case res.Error != nil:
+		tx.Rollback()
+		replyDBError(c, "failed to delete schema", res.Error)
+		return
+	case res.RowsAffected == 0:
+		tx.Rollback()
+		log.Printf("schema for type '%v' not found", typ)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "record not found",
+		})
+		return
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		replyDBError(c, "failed to commit schema removal", err)
+		return
+	}
+	s.schemas.invalidate(typ)
+	log.Printf("schema for type '%v' deleted", typ)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// secretsSetting is a gorm setting with the *secretKeys used by the hooks to encrypt and decrypt the secret fields.
+// The secret fields are stored in plaintext if it is not set.
+const secretsSetting = "config:secrets"
+
+// encryptedPrefix starts the encrypted values: `$enc:v1:<key id>:<base64 of nonce and ciphertext>`.
+// The version describes the format of the rest, so it may be changed later.
+const encryptedPrefix = "$enc:"
+
+// secretFormat is the current version of the encrypted values format.
+const secretFormat = "v1"
+
+// secretNames are the suffixes of the keys which values are secret by convention, compared case-insensitively.
+// The schema of the type may mark more properties as secret with `"secret": true`.
+var secretNames = []string{"password", "secret", "token"}
+
+// secretKeys holds AES-GCM keys by their ids, the current one encrypts the new values,
+// the others are kept to decrypt the values encrypted before the rotation.
+type secretKeys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// parseSecretKeys parses the keys in the form of `id:base64` separated by commas or new lines,
+// the first key is the current one. The keys must be 16, 24 or 32 bytes long.
+func parseSecretKeys(str string) (*secretKeys, error) {
+	keys := &secretKeys{
+		aeads: map[string]cipher.AEAD{},
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.Replace(str, ",", "\n", -1)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("key must be in the form of `id:base64`")
+		}
+		id := parts[0]
+		if _, ok := keys.aeads[id]; ok {
+			return nil, fmt.Errorf("duplicate key id '%v'", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key '%v': %v", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key '%v': %v", id, err)
+		}
+		keys.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key '%v': %v", id, err)
+		}
+		if keys.current == "" {
+			keys.current = id
+		}
+	}
+	if keys.current == "" {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+// loadSecretKeys loads the keys from the TEST_CONFIG_SECRET_KEYS variable or from the file
+// named by TEST_CONFIG_SECRET_KEY_FILE, it returns nil if neither is set.
+func loadSecretKeys() (*secretKeys, error) {
+	str := os.Getenv("TEST_CONFIG_SECRET_KEYS")
+	if path := os.Getenv("TEST_CONFIG_SECRET_KEY_FILE"); str == "" && path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(file)
+		if err != nil {
+			return nil, err
+		}
+		str = buf.String()
+	}
+	if str == "" {
+		return nil, nil
+	}
+	return parseSecretKeys(str)
+}
+
+func (keys *secretKeys) encrypt(value, aad string) (string, error) {
+	aead := keys.aeads[keys.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(aad))
+	return encryptedPrefix + secretFormat + ":" + keys.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (keys *secretKeys) decrypt(value, aad string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 3)
+	if len(parts) != 3 || parts[0] != secretFormat {
+		return "", errors.New("unsupported format of encrypted value")
+	}
+	if keys == nil {
+		return "", errors.New("encrypted value found, but no keys configured")
+	}
+	aead, ok := keys.aeads[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("unknown key '%v' of encrypted value", parts[1])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return string(plain), nil
+}
+
+func getSecretKeys(tx *gorm.DB) *secretKeys {
+	keys, _ := tx.Get(secretsSetting)
+	secrets, _ := keys.(*secretKeys)
+	return secrets
+}
+
+// isSecretName checks whether the key is secret by the naming convention.
+func isSecretName(key string) bool {
+	key = strings.ToLower(key)
+	for _, name := range secretNames {
+		if strings.HasSuffix(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptSecrets encrypts the plaintext string values of the secret fields of the config data.
+// The encrypted values are bound to the type and the name of the config.
+func encryptSecrets(tx *gorm.DB, typ, name string, data postgres.Jsonb) (postgres.Jsonb, error) {
+	keys := getSecretKeys(tx)
+	if keys == nil {
+		return data, nil
+	}
+
+	schema, err := loadSchemaDocument(tx, typ)
+	if err != nil {
+		return data, err
+	}
+	var value interface{}
+	err = decodeJSON(data.RawMessage, &value)
+	if err != nil {
+		return data, err
+	}
+	value, err = walkSecrets(value, schema, false, "", func(_ string, value interface{}) (interface{}, error) {
+		str, ok := value.(string)
+		if !ok || strings.HasPrefix(str, encryptedPrefix) {
+			return value, nil
+		}
+		return keys.encrypt(str, typ+"/"+name)
+	})
+	if err != nil {
+		return data, err
+	}
+	encoded, err := json.Marshal(value)
+	return postgres.Jsonb{RawMessage: encoded}, err
+}
+
+// loadSchemaDocument returns the decoded schema document of the type, it is nil if the type has no schema.
+func loadSchemaDocument(tx *gorm.DB, typ string) (interface{}, error) {
+	stored, err := loadSchema(tx, typ)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	var schema interface{}
+	err = decodeJSON(stored.Document.RawMessage, &schema)
+	return schema, err
+}
+
+// walkSecrets walks the value along with its schema and replaces the scalar values of the secret fields
+// with the results of replace. The fields are secret by the naming convention, by the `"secret": true` mark
+// in the schema or if they are nested into the secret fields. The paths of the fields are dotted.
+func walkSecrets(value, schema interface{}, secret bool, path string,
+	replace func(path string, value interface{}) (interface{}, error)) (interface{}, error) {
+
+	node, _ := schema.(map[string]interface{})
+
+	var err error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		properties, _ := node["properties"].(map[string]interface{})
+		for key, item := range value {
+			property, _ := properties[key].(map[string]interface{})
+			marked, _ := property["secret"].(bool)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			value[key], err = walkSecrets(item, property, secret || marked || isSecretName(key), keyPath, replace)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i], err = walkSecrets(item, node["items"], secret, fmt.Sprintf("%v[%v]", path, i), replace)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case nil:
+	default:
+		if secret {
+			return replace(path, value)
+		}
+	}
+	return value, nil
+}
+
+// decryptSecrets decrypts the encrypted values of the config data. All of them are decrypted regardless
+// of the schema, so the values encrypted before the secret marks changed are still served in plaintext.
+// The writes reject the plaintext values which would be taken for the encrypted ones(see checkPlaintext).
+func decryptSecrets(tx *gorm.DB, typ, name string, data postgres.Jsonb) (postgres.Jsonb, error) {
+	if !bytes.Contains(data.RawMessage, []byte(encryptedPrefix)) {
+		return data, nil
+	}
+
+	var value interface{}
+	err := decodeJSON(data.RawMessage, &value)
+	if err != nil {
+		return data, err
+	}
+	value, err = decryptValue(getSecretKeys(tx), value, typ+"/"+name)
+	if err != nil {
+		return data, fmt.Errorf("config '%v' with type '%v': %v", name, typ, err)
+	}
+	decoded, err := json.Marshal(value)
+	return postgres.Jsonb{RawMessage: decoded}, err
+}
+
+// decryptValue decrypts all the encrypted strings of the value.
+func decryptValue(keys *secretKeys, value interface{}, aad string) (interface{}, error) {
+	var err error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key], err = decryptValue(keys, item, aad)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i], err = decryptValue(keys, item, aad)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case string:
+		if strings.HasPrefix(value, encryptedPrefix) {
+			return keys.decrypt(value, aad)
+		}
+	}
+	return value, nil
+}
+
+// checkPlaintext ensures that no string of the data starts with encryptedPrefix,
+// such a value would be taken for the encrypted one on reads.
+func checkPlaintext(data []byte) error {
+	if !bytes.Contains(data, []byte(encryptedPrefix)) {
+		return nil
+	}
+	var value interface{}
+	err := decodeJSON(data, &value)
+	if err != nil {
+		return err
+	}
+	if hasEncryptedPrefix(value) {
+		return fmt.Errorf("string values must not start with the reserved prefix '%v'", encryptedPrefix)
+	}
+	return nil
+}
+
+func hasEncryptedPrefix(value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, item := range value {
+			if hasEncryptedPrefix(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if hasEncryptedPrefix(item) {
+				return true
+			}
+		}
+	case string:
+		return strings.HasPrefix(value, encryptedPrefix)
+	}
+	return false
+}
+
+// AfterFind decrypts the secret fields of the loaded config.
+func (c *Config) AfterFind(tx *gorm.DB) (err error) {
+	c.Data, err = decryptSecrets(tx, c.Type, c.Name, c.Data)
+	return err
+}
+
+// BeforeCreate encrypts the secret fields of the recorded data.
+// The data of the config is already encrypted, but the previous data is loaded decrypted.
+func (r *Revision) BeforeCreate(tx *gorm.DB) error {
+	for _, data := range []*postgres.Jsonb{r.OldData, r.NewData} {
+		if data == nil {
+			continue
+		}
+		encrypted, err := encryptSecrets(tx, r.Type, r.Name, *data)
+		if err != nil {
+			return err
+		}
+		*data = encrypted
+	}
+	return nil
+}
+
+// AfterFind decrypts the secret fields of the loaded revision.
+func (r *Revision) AfterFind(tx *gorm.DB) error {
+	for _, data := range []*postgres.Jsonb{r.OldData, r.NewData} {
+		if data == nil {
+			continue
+		}
+		decrypted, err := decryptSecrets(tx, r.Type, r.Name, *data)
+		if err != nil {
+			return err
+		}
+		*data = decrypted
+	}
+	return nil
+}
+
+// reencrypt rewrites the secret fields of all configs and revisions with the current key,
+// so the previous keys may be removed after it. The secret fields stored in plaintext are encrypted as well.
+func reencrypt(db *gorm.DB) error {
+	if getSecretKeys(db) == nil {
+		return errors.New("no keys configured")
+	}
+
+	tx := db.Begin()
+	err := rewriteSecrets(tx, "")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// rewriteSecrets encrypts the secret fields of the configs and the revisions of the type(of all types if it is empty)
+// with the current key and the current schema. The values of the fields which are not secret anymore are decrypted.
+func rewriteSecrets(tx *gorm.DB, typ string) error {
+	if getSecretKeys(tx) == nil {
+		return nil
+	}
+	query := tx
+	if typ != "" {
+		query = tx.Where("type = ?", typ)
+	}
+
+	// The data is decrypted by AfterFind.
+	var configs []Config
+	err := query.Find(&configs).Error
+	for i := 0; err == nil && i < len(configs); i++ {
+		config := configs[i]
+		config.Data, err = encryptSecrets(tx, config.Type, config.Name, config.Data)
+		if err == nil {
+			// The update bypasses the hooks, so neither the version nor the revisions are changed.
+			err = tx.Model(&Config{}).Where("type = ? AND name = ?", config.Type, config.Name).
+				UpdateColumn("data", config.Data).Error
+		}
+	}
+
+	var revisions []Revision
+	if err == nil {
+		err = query.Find(&revisions).Error
+	}
+	for i := 0; err == nil && i < len(revisions); i++ {
+		revision := &revisions[i]
+		// BeforeCreate encrypts the data in place.
+		err = revision.BeforeCreate(tx)
+		if err == nil {
+			err = tx.Model(&Revision{}).Where("id = ?", revision.ID).
+				UpdateColumns(map[string]interface{}{
+					"old_data": revision.OldData,
+					"new_data": revision.NewData,
+				}).Error
+		}
+	}
+	return err
+}
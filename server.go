@@ -3,6 +3,9 @@ package main
 import (
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -10,7 +13,25 @@ import (
 )
 
 type configServer struct {
-	db *gorm.DB
+	db    *gorm.DB
+	feed  *changeFeed
+	cache *configCache
+	// lookups coalesces the concurrent loads of the same config on cache misses.
+	lookups *lookupGroup
+	// schemas caches the schemas classifying the secret fields on reads.
+	schemas *schemaCache
+	// tokens caches the API tokens of the authenticated requests.
+	tokens *tokenCache
+	// policies caches the rules of the roles bound to the principals.
+	policies *policyCache
+	// auditLog records the handled requests, they are not recorded if it is nil.
+	auditLog *auditLog
+	// metrics collects the request and db metrics, they are not collected if it is nil.
+	metrics *metrics
+	// identities maps the client certificates to the scopes, nil if they are not used.
+	identities clientIdentities
+	// snapshot is not nil in the snapshot mode, the lookups are served from memory then.
+	snapshot *snapshotStore
 }
 
 // Config represents the associated structure in the database.
@@ -19,18 +40,166 @@ type Config struct {
 	Type string `gorm:"primary_key"`
 	Name string `gorm:"primary_key"`
 	Data postgres.Jsonb
+	// Maintained by gorm, it is sent as Last-Modified.
+	UpdatedAt time.Time
+	// Incremented on every change, starting from 1 on the creation.
+	Version int
+
+	// The state before the change, it is loaded by the hooks.
+	previous *Config
+	// The data with the secret fields in plaintext while the encrypted data is being saved.
+	plain *postgres.Jsonb
+}
+
+// The gorm hooks below guard all the writes, including the ones from migrations.
+
+// BeforeSave validates the data along with the configs extending it, locks the current row of the config, increments the version
+// and encrypts the secret fields.
+func (c *Config) BeforeSave(tx *gorm.DB) error {
+	err := c.validate(tx)
+	if err == nil {
+		err = c.validateDependents(tx)
+	}
+	if err != nil {
+		return err
+	}
+	err = c.loadPrevious(tx)
+	if err != nil {
+		return err
+	}
+
+	c.Version = 1
+	if c.previous != nil {
+		c.Version = c.previous.Version + 1
+	}
+
+	plain := c.Data
+	c.Data, err = encryptSecrets(tx, c.Type, c.Name, c.Data)
+	if err != nil {
+		return err
+	}
+	c.plain = &plain
+	return nil
 }
 
-func newConfigServer(db *gorm.DB) *configServer {
-	return &configServer{db: db}
+// AfterSave records the change in revisions and brings the plaintext data back.
+func (c *Config) AfterSave(scope *gorm.Scope) error {
+	encrypted := c.Data
+	if c.plain != nil {
+		c.Data, c.plain = *c.plain, nil
+	}
+
+	// gorm.DB.Save() falls back to the creation if the update affected nothing,
+	// the change will be recorded after it.
+	if scope.DB().RowsAffected == 0 {
+		return nil
+	}
+	return c.recordRevision(scope.NewDB(), &encrypted)
 }
 
-func (s configServer) handle(c *gin.Context) {
-	var request struct {
-		Type string
-		Name string `json:"Data"`
+// BeforeDelete ensures that the config is not a layer of others and locks its current row.
+func (c *Config) BeforeDelete(tx *gorm.DB) error {
+	err := c.checkDependents(tx)
+	if err != nil {
+		return err
 	}
+	return c.loadPrevious(tx)
+}
+
+// AfterDelete records the removal in revisions.
+func (c *Config) AfterDelete(tx *gorm.DB) error {
+	// Nothing was deleted.
+	if c.previous == nil {
+		return nil
+	}
+	return c.recordRevision(tx, nil)
+}
+
+// lookupRequest is a body of the POST lookup request.
+type lookupRequest struct {
+	Type string
+	Name string `json:"Data"`
+	// Fallback enables the hierarchical name resolution(see resolveConfig).
+	Fallback bool `json:",omitempty"`
+}
+
+func newConfigServer(db *gorm.DB, cache *configCache) *configServer {
+	feed := newChangeFeed(db)
+	go feed.run()
+	go cache.follow(feed)
+	return &configServer{
+		db:       db,
+		feed:     feed,
+		cache:    cache,
+		lookups:  newLookupGroup(),
+		schemas:  newSchemaCache(),
+		tokens:   newTokenCache(),
+		policies: newPolicyCache(),
+	}
+}
+
+// findConfig returns the config from the snapshot or through the cache, it is nil if the config does not exist.
+// It replies with 500 on failure.
+func (s configServer) findConfig(c *gin.Context, typ, name string) (*Config, bool) {
+	config, err := s.getConfig(typ, name)
+	if err != nil {
+		replyDBError(c, "failed to load config data", err)
+		return nil, false
+	}
+	return config, true
+}
+
+// getConfig is findConfig returning the error instead of the reply.
+func (s configServer) getConfig(typ, name string) (*Config, error) {
+	if s.snapshot != nil {
+		return s.snapshot.get(typ, name), nil
+	}
+
+	config, generation, cached := s.cache.get(typ, name)
+	if cached {
+		return config, nil
+	}
+	return s.lookups.do(typ, name, func() (*Config, error) {
+		config, err := s.queryConfig(typ, name)
+		if err == nil {
+			s.cache.put(typ, name, config, generation)
+		}
+		return config, err
+	})
+}
+
+// register attaches all the handlers of the server to r.
+func (s *configServer) register(r gin.IRoutes) {
+	r.POST("/", s.handle)
+	r.GET("/", s.handleQuery)
+	r.POST("/batch", s.handleBatch)
+	r.GET("/types", s.handleTypes)
+	r.GET("/configs", s.handleKeys)
+	r.GET("/configs/:type", s.handleNames)
+	r.GET("/configs/:type/:name", s.handleGet)
+	r.GET("/configs/:type/:name/layers", s.handleLayers)
+	r.GET("/configs/:type/:name/revisions", s.handleRevisions)
+	r.GET("/configs/:type/:name/revisions/:revision", s.handleRevision)
+	r.POST("/configs/:type/:name/revisions/:revision/restore", s.handleRestore)
+	r.POST("/configs/:type/:name", s.handleCreate)
+	r.PUT("/configs/:type/:name", s.handlePut)
+	r.PATCH("/configs/:type/:name", s.handlePatch)
+	r.DELETE("/configs/:type/:name", s.handleDelete)
+	r.GET("/watch/:type/:name", s.handleWatch)
+	r.GET("/events", s.handleEvents)
+	r.GET("/stats/cache", s.handleCacheStats)
+	r.GET("/stats/lookups", s.handleLookupStats)
+	r.GET("/metrics", s.handleMetrics)
+	r.GET("/explain", s.handleExplain)
+	r.GET("/audit", s.handleAudit)
+	r.GET("/schemas/:type", s.handleGetSchema)
+	r.PUT("/schemas/:type", s.handlePutSchema)
+	r.DELETE("/schemas/:type", s.handleDeleteSchema)
+}
 
+// handle serves lookups with the type and the name passed in the JSON body.
+func (s configServer) handle(c *gin.Context) {
+	var request lookupRequest
 	err := c.BindJSON(&request)
 	if err != nil {
 		log.Printf("failed to decode request: %v", err)
@@ -40,35 +209,127 @@ func (s configServer) handle(c *gin.Context) {
 		return
 	}
 
-	if request.Type == "" || request.Name == "" {
+	s.lookup(c, request.Type, request.Name, request.Fallback)
+}
+
+// handleQuery serves lookups in the form of `GET /?Type=...&Data=...&Fallback=...`,
+// the parameter names are the same as the fields of the POST body.
+func (s configServer) handleQuery(c *gin.Context) {
+	s.lookup(c, c.Query("Type"), c.Query("Data"), queryFlag(c, "Fallback"))
+}
+
+// handleGet serves lookups in the form of `GET /configs/:type/:name?fallback=...`.
+// The data as of the past revision is served if the `revision` or the `at` query parameter is passed.
+func (s configServer) handleGet(c *gin.Context) {
+	if c.Query("revision") != "" || c.Query("at") != "" {
+		if !authorize(c, accessRead, c.Param("type"), c.Param("name")) {
+			return
+		}
+		s.lookupRevision(c, c.Param("type"), c.Param("name"))
+		return
+	}
+	s.lookup(c, c.Param("type"), c.Param("name"), queryFlag(c, "fallback"))
+}
+
+// lookup writes the data of the requested config as a reply,
+// all the request handlers share it to keep the same error semantics.
+func (s configServer) lookup(c *gin.Context, typ, name string, fallback bool) {
+	auditConfig(c, accessRead, typ, name)
+	if typ == "" || name == "" {
 		log.Println("incomplite request: empty type or data")
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "empty type or data",
 		})
 		return
 	}
-
-	config := Config{
-		Type: request.Type,
-		Name: request.Name,
+	if !authorize(c, accessRead, typ, name) {
+		return
 	}
 
-	res := s.db.First(&config)
-	switch {
-	case res.RecordNotFound():
-		log.Printf("config '%v' with type '%v' not found", request.Name, request.Type)
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "record not found",
-		})
+	var config *Config
+	var ok bool
+	if fallback {
+		config, ok = s.resolveConfig(c, typ, name)
+	} else {
+		config, ok = s.findConfig(c, typ, name)
+	}
+	if !ok {
 		return
-	case res.Error != nil:
-		log.Printf("failed to load config data: %v", res.Error)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "db error",
-		})
+	}
+	if config == nil {
+		replyNotFound(c, typ, name)
+		return
+	}
+	// The fallback may match a config the caller can not read.
+	if config.Name != name && !authorize(c, accessRead, typ, config.Name) {
+		return
+	}
+	metadata := c.Query("view") == "metadata"
+	data, secrets, ok := s.resolvedData(c, config, metadata)
+	if !ok {
 		return
-	default:
-		c.JSON(http.StatusOK, config.Data.RawMessage)
+	}
+	if metadata {
+		s.replyMetadata(c, config, data, secrets)
+		return
+	}
+
+	modified := config.UpdatedAt
+	if hasLayers(config.Data.RawMessage) || hasRefs(config.Data.RawMessage) {
+		// The layers and the referenced configs may have been changed later than the config itself.
+		modified = time.Time{}
+	}
+
+	// The tag is computed on the served data, so it discloses nothing about the masked secrets.
+	data, ok = s.visibleData(c, typ, config.Name, data)
+	if !ok {
+		return
+	}
+	c.Header(versionHeader, strconv.Itoa(config.Version))
+	if notModified(c, dataETag(data), modified) {
 		return
 	}
+	c.JSON(http.StatusOK, data)
+}
+
+// defaultName is the last resort of the hierarchical name resolution.
+const defaultName = "default"
+
+// matchedNameHeader carries the name of the config matched by the hierarchical name resolution.
+const matchedNameHeader = "X-Config-Name"
+
+// resolveConfig looks up the config by the dotted name falling back to its parents:
+// `a.b.c`, then `a.b`, then `a` and finally `default`.
+// The name of the matched config is written into the reply headers.
+func (s configServer) resolveConfig(c *gin.Context, typ, name string) (*Config, bool) {
+	for _, candidate := range fallbackNames(name) {
+		config, ok := s.findConfig(c, typ, candidate)
+		if !ok {
+			return nil, false
+		}
+		if config != nil {
+			c.Header(matchedNameHeader, config.Name)
+			return config, true
+		}
+	}
+	return nil, true
+}
+
+// fallbackNames returns the names checked by resolveConfig in order.
+func fallbackNames(name string) []string {
+	names := []string{name}
+	for i := strings.LastIndex(name, "."); i > 0; i = strings.LastIndex(name, ".") {
+		name = name[:i]
+		names = append(names, name)
+	}
+	if names[len(names)-1] != defaultName {
+		names = append(names, defaultName)
+	}
+	return names
+}
+
+// queryFlag reports whether the boolean query parameter is set to true.
+func queryFlag(c *gin.Context, key string) bool {
+	value, _ := strconv.ParseBool(c.Query(key))
+	return value
 }
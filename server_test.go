@@ -1,26 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
-var db *gorm.DB
+var (
+	db       *gorm.DB
+	dbConfig string
+)
 
 func TestMain(m *testing.M) {
-	dbConfig := os.Getenv("TEST_CONFIG_DB")
+	dbConfig = os.Getenv("TEST_CONFIG_DB")
 	if dbConfig == "" {
 		log.Fatal("please, set TEST_CONFIG_DB variable before running the tests")
 	}
@@ -41,11 +59,17 @@ func TestMain(m *testing.M) {
 }
 
 type testQuery struct {
+	// http method, POST if empty
+	method string
+	// request path with the query string, "/" if empty
+	path string
+	// additional request headers
+	headers map[string]string
 	// request doby
 	request string
 	// expecded status code
 	code int
-	// expected json reply for 200 status
+	// expected json reply, the body is not checked if empty
 	data string
 }
 
@@ -94,35 +118,1104 @@ func TestConfigServer(t *testing.T) {
 				"virtualhost": "/"
 			}`,
 		},
+		{
+			method: "GET",
+			path:   "/configs/database.postgres/service.test",
+			code:   http.StatusOK,
+			data: `
+			{
+				"host": "localhost",
+				"port": "5432",
+				"database": "devdb",
+				"user": "mr_robot",
+				"password": "secret",
+				"schema": "public"
+			}`,
+		},
+		{
+			method: "GET",
+			path:   "/configs/does.not.exist/service.test",
+			code:   http.StatusNotFound,
+		},
+		{
+			method: "GET",
+			path:   "/?Type=rabbit.log&Data=service.test",
+			code:   http.StatusOK,
+			data: `
+			{
+				"host": "10.0.5.42",
+				"port": "5671",
+				"virtualhost": "/",
+				"user": "guest",
+				"password": "guest"
+			}`,
+		},
+		{
+			method: "GET",
+			path:   "/?Type=rabbit.log",
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	queries = append(queries, writeQueries...)
+	queries = append(queries, batchQueries...)
+	queries = append(queries, listQueries...)
+	queries = append(queries, schemaQueries...)
+	queries = append(queries, revisionQueries...)
+	queries = append(queries, fallbackQueries...)
+	queries = append(queries, layerQueries...)
+	queries = append(queries, refQueries...)
+	queries = append(queries, maskQueries...)
+
+	// Revisions survive the removal of configs, the ones from the previous runs are dropped
+	// to keep the revision numbers predictable.
+	err := db.Delete(&Revision{}, "type = ?", "write.test").Error
+	if err != nil {
+		t.Fatalf("failed to clean up revisions: %v", err)
+	}
+
+	ts := newTestServer()
+	defer ts.Close()
+
+	for _, query := range queries {
+		checkQuery(t, ts, query)
+	}
+}
+
+// testSecretsToken authorizes the test queries to read the secret fields.
+const testSecretsToken = "test-secrets-token"
+
+func newTestServer() *httptest.Server {
+	r := gin.New()
+	r.Use(recovery, secretsAccess(testSecretsToken))
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	newConfigServer(db, cache).register(r)
+	return httptest.NewServer(r)
+}
+
+func TestConditionalGet(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	path := "/configs/database.postgres/service.test"
+	headers := checkQuery(t, ts, testQuery{method: "GET", path: path, code: http.StatusOK})
+	etag := headers.Get("ETag")
+	modified := headers.Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("unexpected reply: ETag '%v', Last-Modified '%v'", etag, modified)
+	}
+
+	checks := []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other", W/` + etag, http.StatusNotModified},
+		{"If-None-Match", "*", http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", modified, http.StatusNotModified},
+		{"If-Modified-Since", "Sat, 01 Jan 2000 00:00:00 GMT", http.StatusOK},
+	}
+	for _, check := range checks {
+		headers := checkQuery(t, ts, testQuery{
+			method:  "GET",
+			path:    path,
+			headers: map[string]string{check.header: check.value},
+			code:    check.code,
+		})
+		if headers.Get("ETag") != etag {
+			t.Errorf("%v: %v: ETag changed to '%v'", check.header, check.value, headers.Get("ETag"))
+		}
+	}
+}
+
+func TestLayeredPrecondition(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	defer db.Where("type = ?", "precondition.test").Delete(&Revision{})
+
+	path := "/configs/precondition.test/service.test"
+	for _, config := range []struct{ path, data string }{
+		{"/configs/precondition.test/base", `{"host": "a"}`},
+		{path, `{"$extends": ["base"], "port": 1}`},
+	} {
+		checkQuery(t, ts, testQuery{method: "PUT", path: config.path, request: config.data, code: http.StatusCreated})
+		// The layer is deleted after the config extending it.
+		defer checkQuery(t, ts, testQuery{
+			method:  "DELETE",
+			path:    config.path,
+			headers: map[string]string{"If-Match": "*"},
+			code:    http.StatusNoContent,
+		})
+	}
+
+	// The tag of the lookup is the tag of the merged data, the updates must accept it.
+	etag := checkQuery(t, ts, testQuery{method: "GET", path: path, code: http.StatusOK}).Get("ETag")
+	// If-Match uses the strong comparison, the weak tags never match.
+	checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    path,
+		headers: map[string]string{"If-Match": "W/" + etag},
+		request: `{"$extends": ["base"], "port": 2}`,
+		code:    http.StatusPreconditionFailed,
+	})
+	headers := checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    path,
+		headers: map[string]string{"If-Match": etag},
+		request: `{"$extends": ["base"], "port": 2}`,
+		code:    http.StatusNoContent,
+	})
+	updated := checkQuery(t, ts, testQuery{method: "GET", path: path, code: http.StatusOK}).Get("ETag")
+	if headers.Get("ETag") != updated {
+		t.Errorf("ETag of the update '%v' differs from the one of the lookup '%v'", headers.Get("ETag"), updated)
+	}
+	checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    path,
+		headers: map[string]string{"If-Match": etag},
+		request: `{"$extends": ["base"], "port": 3}`,
+		code:    http.StatusPreconditionFailed,
+	})
+
+	// The tag of the config with the secrets is the one given to the caller, the masked one included.
+	secret := "/configs/precondition.test/secret.test"
+	checkQuery(t, ts, testQuery{method: "PUT", path: secret, request: `{"password": "a"}`, code: http.StatusCreated})
+	defer checkQuery(t, ts, testQuery{
+		method:  "DELETE",
+		path:    secret,
+		headers: map[string]string{"If-Match": "*"},
+		code:    http.StatusNoContent,
+	})
+	etag = checkQuery(t, ts, testQuery{method: "GET", path: secret, code: http.StatusOK}).Get("ETag")
+	checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    secret,
+		headers: map[string]string{"If-Match": etag},
+		request: `{"password": "b"}`,
+		code:    http.StatusNoContent,
+	})
+	etag = checkQuery(t, ts, testQuery{method: "GET", path: secret, headers: unprivileged, code: http.StatusOK}).Get("ETag")
+	checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    secret,
+		headers: map[string]string{secretsTokenHeader: "", "If-Match": etag},
+		request: `{"password": "c"}`,
+		code:    http.StatusNoContent,
+	})
+	checkQuery(t, ts, testQuery{method: "GET", path: secret, code: http.StatusOK, data: `{"password": "c"}`})
+}
+
+func TestWatch(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	path := "/configs/watch.test/service.test"
+	watchPath := "/watch/watch.test/service.test"
+
+	checkQuery(t, ts, testQuery{method: "PUT", path: path, request: `{"host": "a"}`, code: http.StatusCreated})
+	// The config is changed twice below.
+	defer checkQuery(t, ts, testQuery{method: "DELETE", path: path + "?version=3", code: http.StatusNoContent})
+
+	checkQuery(t, ts, testQuery{method: "GET", path: watchPath + "?version=1&timeout=100ms", code: http.StatusNotModified})
+	headers := checkQuery(t, ts, testQuery{method: "GET", path: watchPath + "?version=0", code: http.StatusOK})
+	if headers.Get(versionHeader) != "1" {
+		t.Errorf("watch of the missing config: unexpected version '%v'", headers.Get(versionHeader))
+	}
+
+	// The blocked watches are performed off the test goroutine, so their replies are checked by the test itself.
+	type watchReply struct {
+		resp *http.Response
+		err  error
+	}
+	// The buffer lets the watch finish even if the test has failed before receiving its reply.
+	done := make(chan watchReply, 1)
+	watch := func(path string) {
+		resp, err := http.Get(ts.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- watchReply{resp, err}
 	}
+	// checkWatch waits for the blocked watch and checks that it has returned the version.
+	checkWatch := func(what, version string) {
+		reply := <-done
+		if reply.err != nil {
+			t.Fatalf("%v: failed to perform http request: %v", what, reply.err)
+		}
+		if reply.resp.StatusCode != http.StatusOK || reply.resp.Header.Get(versionHeader) != version {
+			t.Errorf("%v: unexpected status %v, version '%v'", what, reply.resp.StatusCode, reply.resp.Header.Get(versionHeader))
+		}
+	}
+
+	go watch(watchPath + "?version=1&timeout=10s")
+	// Let the watcher block.
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	checkQuery(t, ts, testQuery{method: "PATCH", path: path + "?version=1", request: `{"host": "b"}`, code: http.StatusNoContent})
+
+	checkWatch("blocked watch", "2")
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("blocked watch took too long to return")
+	}
+
+	// The change of the layer does not bump the version, but changes the served data.
+	layered := "/configs/watch.test/layered.test"
+	checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    layered,
+		request: `{"$extends": ["service.test"], "port": 1}`,
+		code:    http.StatusCreated,
+	})
+	defer checkQuery(t, ts, testQuery{method: "DELETE", path: layered + "?version=1", code: http.StatusNoContent})
+
+	go watch("/watch/watch.test/layered.test?version=1&timeout=10s")
+	time.Sleep(100 * time.Millisecond)
+
+	checkQuery(t, ts, testQuery{method: "PATCH", path: path + "?version=2", request: `{"host": "c"}`, code: http.StatusNoContent})
+	checkWatch("watch of the layered config", "1")
+}
+
+func TestETagMatches(t *testing.T) {
+	checks := []struct {
+		header string
+		weak   bool
+		strong bool
+	}{
+		{`"a"`, true, true},
+		{`"b", "a"`, true, true},
+		{"*", true, true},
+		{`W/"a"`, true, false},
+		{`"b"`, false, false},
+	}
+	for _, check := range checks {
+		if etagMatches(check.header, `"a"`) != check.weak {
+			t.Errorf("weak comparison of '%v': %v expected", check.header, check.weak)
+		}
+		if etagMatchesStrong(check.header, `"a"`) != check.strong {
+			t.Errorf("strong comparison of '%v': %v expected", check.header, check.strong)
+		}
+	}
+	if etagMatchesStrong(`W/"a"`, `W/"a"`) {
+		t.Error("weak tag matches itself in the strong comparison")
+	}
+}
+
+func TestConfigCache(t *testing.T) {
+	cache := newConfigCache(2, time.Minute, 50*time.Millisecond)
+	config := &Config{Type: "cache.test", Name: "a"}
+
+	_, generation, ok := cache.get("cache.test", "a")
+	if ok {
+		t.Fatal("empty cache hit")
+	}
+	cache.put("cache.test", "a", config, generation)
+	if cached, _, ok := cache.get("cache.test", "a"); !ok || cached != config {
+		t.Errorf("cached config is not returned")
+	}
+
+	// Negative caching expires faster.
+	_, generation, _ = cache.get("cache.test", "b")
+	cache.put("cache.test", "b", nil, generation)
+	if cached, _, ok := cache.get("cache.test", "b"); !ok || cached != nil {
+		t.Errorf("missing config is not cached")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, _, ok := cache.get("cache.test", "b"); ok {
+		t.Errorf("missing config is cached after expiration")
+	}
+
+	// The data loaded before the invalidation is not cached.
+	_, generation, _ = cache.get("cache.test", "c")
+	cache.invalidate("cache.test", "c")
+	cache.put("cache.test", "c", config, generation)
+	if _, _, ok := cache.get("cache.test", "c"); ok {
+		t.Errorf("stale config is cached")
+	}
+
+	// The least recently used config is evicted.
+	for _, name := range []string{"b", "c"} {
+		_, generation, _ = cache.get("cache.test", name)
+		cache.put("cache.test", name, config, generation)
+	}
+	if _, _, ok := cache.get("cache.test", "a"); ok {
+		t.Errorf("least recently used config is not evicted")
+	}
+	if cache.len() != 2 {
+		t.Errorf("cache size is %v, but 2 expected", cache.len())
+	}
+
+	if cache.hits != 2 || cache.misses != 8 {
+		t.Errorf("unexpected counters: %v hits, %v misses", cache.hits, cache.misses)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	snapshot, err := newSnapshotStore(db, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	server := newConfigServer(db, newConfigCache(0, 0, 0))
+	server.snapshot = snapshot
+	go snapshot.follow(server.feed)
 
 	r := gin.New()
-	r.Use(gin.Recovery())
-	r.POST("/", newConfigServer(db).handle)
+	server.register(r)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	for _, query := range queries {
+	path := "/configs/snapshot.test/service.test"
+	checkQuery(t, ts, testQuery{method: "PUT", path: path, request: `{"host": "a"}`, code: http.StatusCreated})
+	// The created config is served from the snapshot.
+	checkQuery(t, ts, testQuery{method: "GET", path: path, code: http.StatusOK, data: `{"host": "a"}`})
+
+	// The batch is served from the snapshot as well, without the db.
+	closed, err := gorm.Open("postgres", dbConfig)
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	closed.Close()
+	offline := *server
+	offline.db = closed
+	r = gin.New()
+	offline.register(r)
+	offlineServer := httptest.NewServer(r)
+	defer offlineServer.Close()
+	checkQuery(t, offlineServer, testQuery{
+		path:    "/batch",
+		request: `[{"Type": "snapshot.test", "Data": "service.test"}]`,
+		code:    http.StatusOK,
+		data:    `[{"Type": "snapshot.test", "Data": "service.test", "status": "found", "config": {"host": "a"}}]`,
+	})
+
+	// The change made bypassing the server is picked up from the change feed.
+	err = db.Delete(&Config{Type: "snapshot.test", Name: "service.test"}).Error
+	if err != nil {
+		t.Fatalf("failed to delete config: %v", err)
+	}
+	for i := 0; ; i++ {
+		resp := sendQuery(t, ts, testQuery{method: "GET", path: path})
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			break
+		}
+		if i == 50 {
+			t.Fatal("deleted config is still served from snapshot")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestBatchQueries(t *testing.T) {
+	counted, err := gorm.Open("postgres", dbConfig)
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	defer counted.Close()
+	counted.LogMode(false)
+	var queries int64
+	counted.Callback().Query().After("gorm:query").Register("test:count_configs", func(scope *gorm.Scope) {
+		if scope.TableName() == "configs" {
+			atomic.AddInt64(&queries, 1)
+		}
+	})
+
+	r := gin.New()
+	r.Use(secretsAccess(testSecretsToken))
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	newConfigServer(counted, cache).register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	query := testQuery{
+		path: "/batch",
+		request: `[
+			{"Type": "database.postgres", "Data": "service.test"},
+			{"Type": "rabbit.log", "Data": "service.test"},
+			{"Type": "rabbit.log", "Data": "does not exist"},
+			{"Type": "rabbit.log", "Data": "service.test.batch", "Fallback": true}
+		]`,
+		code: http.StatusOK,
+	}
+	// The misses are loaded with a single query, then the batch is served from the cache.
+	for i, expected := range []int64{1, 1} {
+		checkQuery(t, ts, query)
+		if n := atomic.LoadInt64(&queries); n != expected {
+			t.Errorf("batch %v: %v queries of configs performed(%v expected)", i, n, expected)
+		}
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	const waiters = 10
+	group := newLookupGroup()
+	config := &Config{Type: "coalesce.test", Name: "service.test"}
+
+	release := make(chan struct{})
+	results := make(chan *Config, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			loaded, _ := group.do(config.Type, config.Name, func() (*Config, error) {
+				<-release
+				return config, nil
+			})
+			results <- loaded
+		}()
+	}
+
+	for i := 0; atomic.LoadInt64(&group.coalesced) != waiters-1; i++ {
+		if i == 100 {
+			t.Fatalf("%v loads coalesced, but %v expected", atomic.LoadInt64(&group.coalesced), waiters-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+
+	for i := 0; i < waiters; i++ {
+		if loaded := <-results; loaded != config {
+			t.Errorf("unexpected result of the coalesced load: %+v", loaded)
+		}
+	}
+	if group.queries != 1 {
+		t.Errorf("%v queries performed, but 1 expected", group.queries)
+	}
+
+	// The load started after the change does not join the one started before it.
+	stale := make(chan *Config)
+	release = make(chan struct{})
+	go func() {
+		loaded, _ := group.do(config.Type, config.Name, func() (*Config, error) {
+			<-release
+			return config, nil
+		})
+		stale <- loaded
+	}()
+	for i := 0; atomic.LoadInt64(&group.queries) != 2; i++ {
+		if i == 100 {
+			t.Fatal("load is not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	group.forget(config.Type, config.Name)
+	changed := &Config{Type: config.Type, Name: config.Name, Version: 2}
+	loaded, _ := group.do(config.Type, config.Name, func() (*Config, error) {
+		return changed, nil
+	})
+	close(release)
+	if loaded != changed || <-stale != config {
+		t.Errorf("load after the change returned %+v", loaded)
+	}
+
+	// The panicked load does not block its waiters and the later loads.
+	release = make(chan struct{})
+	go func() {
+		defer func() {
+			recover()
+		}()
+		group.do(config.Type, config.Name, func() (*Config, error) {
+			<-release
+			panic("load failed")
+		})
+	}()
+	for i := 0; atomic.LoadInt64(&group.queries) != 4; i++ {
+		if i == 100 {
+			t.Fatal("load is not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waiter := make(chan error)
+	go func() {
+		_, err := group.do(config.Type, config.Name, func() (*Config, error) {
+			return config, nil
+		})
+		waiter <- err
+	}()
+	for i := 0; atomic.LoadInt64(&group.coalesced) != waiters; i++ {
+		if i == 100 {
+			t.Fatal("load is not joined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	if err := <-waiter; err != errLookupPanicked {
+		t.Errorf("unexpected error of the panicked load waiter: %v", err)
+	}
+	loaded, err := group.do(config.Type, config.Name, func() (*Config, error) {
+		return changed, nil
+	})
+	if loaded != changed || err != nil {
+		t.Errorf("load after the panicked one returned %+v, %v", loaded, err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	feed := newChangeFeed(db)
+	schemas := newSchemaCache()
+	go feed.run()
+	go feed.listen(dbConfig, schemas)
+
+	for i := 0; atomic.LoadInt32(&feed.listening) == 0; i++ {
+		if i == 100 {
+			t.Fatal("listener is not connected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	sub := feed.subscribe(func(event changeEvent) bool {
+		return event.Type == "listen.test"
+	})
+	defer sub.close()
+
+	// The polling is suspended, so the changes made bypassing the feed are delivered by the notifications only.
+	config := &Config{
+		Type: "listen.test",
+		Name: "service.test",
+		Data: toJsonb(`{"host": "a"}`),
+	}
+	err := db.Create(config).Error
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+	defer db.Delete(config)
+
+	select {
+	case event := <-sub.events:
+		if event.Name != config.Name || event.Action != actionCreated {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("change is not delivered")
+	}
+
+	// The schema changed by another instance is dropped from the cache.
+	schemas.mu.Lock()
+	schemas.entries["listen.test"] = schemaCacheEntry{expires: time.Now().Add(time.Hour)}
+	schemas.mu.Unlock()
+	err = db.Create(&Schema{Type: "listen.test", Document: toJsonb(`{"type": "object"}`)}).Error
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	defer db.Delete(&Schema{Type: "listen.test"})
+	for i := 0; ; i++ {
+		schemas.mu.Lock()
+		_, cached := schemas.entries["listen.test"]
+		schemas.mu.Unlock()
+		if !cached {
+			break
+		}
+		if i == 100 {
+			t.Fatal("changed schema is still cached")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	// readEvent returns id and name of the next event in the stream.
+	readEvent := func(r *bufio.Reader) (id, name string) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read event: %v", err)
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "" && id != "":
+				return id, name
+			case strings.HasPrefix(line, "id:"):
+				id = strings.TrimPrefix(line, "id:")
+			case strings.HasPrefix(line, "event:"):
+				name = strings.TrimPrefix(line, "event:")
+			}
+		}
+	}
+
+	// The streams are read by the test, so their bodies are left open.
+	stream := sendQuery(t, ts, testQuery{method: "GET", path: "/events?type_prefix=events."})
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v of the stream", stream.StatusCode)
+	}
+
+	path := "/configs/events.test/service.test"
+	for _, query := range []testQuery{
+		{method: "PUT", path: path, request: `{"host": "a"}`, code: http.StatusCreated},
+		{method: "PUT", path: "/configs/other.test/service.test", request: `{"host": "a"}`, code: http.StatusCreated},
+		{method: "DELETE", path: "/configs/other.test/service.test?version=1", code: http.StatusNoContent},
+		{method: "DELETE", path: path + "?version=1", code: http.StatusNoContent},
+	} {
 		checkQuery(t, ts, query)
 	}
+
+	events := bufio.NewReader(stream.Body)
+	createdID, name := readEvent(events)
+	if name != actionCreated {
+		t.Errorf("'%v' event received, but '%v' expected", name, actionCreated)
+	}
+	deletedID, name := readEvent(events)
+	if name != actionDeleted {
+		t.Errorf("'%v' event received, but '%v' expected", name, actionDeleted)
+	}
+
+	// Resumption after the first event.
+	resumed := sendQuery(t, ts, testQuery{
+		method:  "GET",
+		path:    "/events?type_prefix=events.",
+		headers: map[string]string{"Last-Event-Id": createdID},
+	})
+	defer resumed.Body.Close()
+	id, name := readEvent(bufio.NewReader(resumed.Body))
+	if id != deletedID || name != actionDeleted {
+		t.Errorf("resumed stream started with '%v' event %v, but '%v' event %v expected", name, id, actionDeleted, deletedID)
+	}
+}
+
+func TestRestoreRejected(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	defer db.Where("type = ?", "restore.test").Delete(&Revision{})
+
+	// The data written bypassing the hooks can not be saved as is, the restoration is rejected as the writes are.
+	data := toJsonb(`[1, 2]`)
+	err := db.Create(&Revision{
+		Type:     "restore.test",
+		Name:     "service.test",
+		Revision: 1,
+		Author:   "test",
+		NewData:  &data,
+	}).Error
+	if err != nil {
+		t.Fatalf("failed to create revision: %v", err)
+	}
+	checkQuery(t, ts, testQuery{
+		path: "/configs/restore.test/service.test/revisions/1/restore",
+		code: http.StatusUnprocessableEntity,
+		data: `{"error": "data must be a JSON object"}`,
+	})
+	checkQuery(t, ts, testQuery{method: "GET", path: "/configs/restore.test/service.test", code: http.StatusNotFound})
 }
 
-func checkQuery(t *testing.T, ts *httptest.Server, query testQuery) {
-	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(query.request))
+func TestSchemaLock(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	defer db.Where("type = ?", "schemalock.test").Delete(&Revision{})
+
+	// The schema being created blocks the config writes of the type till it is committed.
+	tx := db.Begin()
+	err := lockSchemaType(tx, "schemalock.test", false)
+	if err != nil {
+		tx.Rollback()
+		t.Fatalf("failed to lock schema: %v", err)
+	}
+	// The write is performed off the test goroutine, so its reply is checked by the test itself.
+	type writeReply struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan writeReply, 1)
+	go func() {
+		req, err := http.NewRequest("PUT", ts.URL+"/configs/schemalock.test/service.test", strings.NewReader(`{"port": "1"}`))
+		if err != nil {
+			done <- writeReply{nil, err}
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- writeReply{resp, err}
+	}()
+
+	select {
+	case <-done:
+		tx.Rollback()
+		t.Fatal("config is written while the schema is being created")
+	case <-time.After(200 * time.Millisecond):
+	}
+	err = tx.Create(&Schema{
+		Type:     "schemalock.test",
+		Document: toJsonb(`{"type": "object", "properties": {"port": {"type": "integer"}}}`),
+	}).Error
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
 	if err != nil {
-		t.Fatalf("request '%v': failed to perform http request: %v", query.request, err)
+		t.Fatalf("failed to create schema: %v", err)
 	}
+	defer checkQuery(t, ts, testQuery{method: "DELETE", path: "/schemas/schemalock.test", code: http.StatusNoContent})
+
+	reply := <-done
+	if reply.err != nil {
+		t.Fatalf("failed to perform http request: %v", reply.err)
+	}
+	if reply.resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("config violating the created schema: unexpected status %v", reply.resp.StatusCode)
+		checkQuery(t, ts, testQuery{method: "DELETE", path: "/configs/schemalock.test/service.test?version=1", code: http.StatusNoContent})
+	}
+}
+
+// writeQueries create, modify and finally remove the "write.test" config.
+var writeQueries = []testQuery{
+	{
+		path:    "/configs/write.test/service.test",
+		request: `[1, 2]`,
+		code:    http.StatusBadRequest,
+	},
+	{
+		path:    "/configs/write.test/service.test",
+		request: `{"host": "a", "port": "1"}`,
+		code:    http.StatusCreated,
+		data:    `{"host": "a", "port": "1"}`,
+	},
+	{
+		path:    "/configs/write.test/service.test",
+		request: `{"host": "a", "port": "1"}`,
+		code:    http.StatusConflict,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/write.test/service.test",
+		request: `{"host": "b"}`,
+		code:    http.StatusPreconditionRequired,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/write.test/service.test?version=7",
+		request: `{"host": "b"}`,
+		code:    http.StatusPreconditionFailed,
+		data:    `{"error": "version mismatch", "version": 1}`,
+	},
+	{
+		method:  "PATCH",
+		path:    "/configs/write.test/service.test",
+		headers: map[string]string{"If-Match": `"not the actual etag"`},
+		request: `{"host": "b"}`,
+		code:    http.StatusPreconditionFailed,
+		data:    `{"error": "version mismatch", "version": 1}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/write.test/service.test?version=1",
+		request: `{"host": "b", "port": "1", "extra": {"a": 1, "b": 2}}`,
+		code:    http.StatusNoContent,
+	},
+	{
+		method:  "PATCH",
+		path:    "/configs/write.test/service.test",
+		headers: map[string]string{"If-Match": "*"},
+		request: `{"port": null, "user": "u", "extra": {"a": null}}`,
+		code:    http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/write.test/service.test",
+		code:   http.StatusPreconditionRequired,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test",
+		code:   http.StatusOK,
+		data:   `{"host": "b", "user": "u", "extra": {"b": 2}}`,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/write.test/service.test?version=3",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/write.test/service.test",
+		code:   http.StatusNotFound,
+	},
+	{
+		method:  "PATCH",
+		path:    "/configs/write.test/service.test",
+		request: `{"host": "c"}`,
+		code:    http.StatusNotFound,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/write.test/service.test",
+		request: `{"host": "c"}`,
+		code:    http.StatusCreated,
+		data:    `{"host": "c"}`,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/write.test/service.test?version=1",
+		code:   http.StatusNoContent,
+	},
+}
+
+var batchQueries = []testQuery{
+	{
+		path:    "/batch",
+		request: `{"Type": "rabbit.log", "Data": "service.test"}`,
+		code:    http.StatusBadRequest,
+	},
+	{
+		path:    "/batch",
+		request: `[]`,
+		code:    http.StatusOK,
+		data:    `[]`,
+	},
+	{
+		path: "/batch",
+		request: `[
+			{"Type": "rabbit.log", "Data": "service.test"},
+			{"Type": "rabbit.log", "Data": "does not exist"},
+			{"Type": "", "Data": "service.test"},
+			{"Type": "rabbit.log", "Data": "service.test.batch", "Fallback": true}
+		]`,
+		code: http.StatusOK,
+		data: `[
+			{
+				"Type": "rabbit.log",
+				"Data": "service.test",
+				"status": "found",
+				"config": {
+					"host": "10.0.5.42",
+					"port": "5671",
+					"virtualhost": "/",
+					"user": "guest",
+					"password": "guest"
+				}
+			},
+			{"Type": "rabbit.log", "Data": "does not exist", "status": "not found"},
+			{"Type": "", "Data": "service.test", "status": "error", "error": "empty type or data"},
+			{
+				"Type": "rabbit.log",
+				"Data": "service.test.batch",
+				"status": "found",
+				"matched": "service.test",
+				"config": {
+					"host": "10.0.5.42",
+					"port": "5671",
+					"virtualhost": "/",
+					"user": "guest",
+					"password": "guest"
+				}
+			}
+		]`,
+	},
+}
+
+// listQueries expect only the test data from the migrations in the db.
+var listQueries = []testQuery{
+	{
+		method: "GET",
+		path:   "/types?limit=1",
+		code:   http.StatusOK,
+		data:   `{"items": ["database.postgres"], "next": "WyJkYXRhYmFzZS5wb3N0Z3JlcyJd"}`,
+	},
+	{
+		method: "GET",
+		path:   "/types?limit=1&cursor=WyJkYXRhYmFzZS5wb3N0Z3JlcyJd",
+		code:   http.StatusOK,
+		data:   `{"items": ["rabbit.log"]}`,
+	},
+	{
+		method: "GET",
+		path:   "/types?prefix=rabbit.",
+		code:   http.StatusOK,
+		data:   `{"items": ["rabbit.log"]}`,
+	},
+	{
+		method: "GET",
+		path:   "/types?limit=0",
+		code:   http.StatusBadRequest,
+	},
+	{
+		method: "GET",
+		path:   "/types?cursor=^_^",
+		code:   http.StatusBadRequest,
+	},
+	{
+		method: "GET",
+		path:   "/configs/rabbit.log?prefix=service",
+		code:   http.StatusOK,
+		data:   `{"items": ["service.test"]}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs/does.not.exist",
+		code:   http.StatusOK,
+		data:   `{"items": []}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs?name_prefix=service.",
+		code:   http.StatusOK,
+		data: `{"items": [
+			{"Type": "database.postgres", "Data": "service.test"},
+			{"Type": "rabbit.log", "Data": "service.test"}
+		]}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs?type_prefix=rabbit&name_prefix=service.",
+		code:   http.StatusOK,
+		data:   `{"items": [{"Type": "rabbit.log", "Data": "service.test"}]}`,
+	},
+}
+
+var schemaQueries = []testQuery{
+	{
+		method:  "PUT",
+		path:    "/configs/database.postgres/write.test",
+		request: `{"host": "localhost", "prot": "5432", "database": "db", "user": "u", "password": ""}`,
+		code:    http.StatusUnprocessableEntity,
+		data: `{
+			"error": "data does not match the schema",
+			"violations": ["$.port: required property is missing", "$.prot: property is not allowed"]
+		}`,
+	},
+	{
+		method: "GET",
+		path:   "/schemas/rabbit.log",
+		code:   http.StatusOK,
+	},
+	{
+		method:  "PUT",
+		path:    "/schemas/write.test",
+		request: `{"type": "object", "properties": {"host": {"type": "string"}}}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/write.test/service.test",
+		request: `{"host": 1}`,
+		code:    http.StatusUnprocessableEntity,
+		data: `{
+			"error": "data does not match the schema",
+			"violations": ["$.host: expected string, got number"]
+		}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/write.test/service.test",
+		request: `{"host": "a"}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method:  "PUT",
+		path:    "/schemas/write.test",
+		request: `{"type": "object", "required": ["port"]}`,
+		code:    http.StatusUnprocessableEntity,
+		data: `{
+			"error": "existing configs do not match the schema",
+			"violations": {"service.test": ["$.port: required property is missing"]}
+		}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/schemas/write.test",
+		request: `{"type": "float"}`,
+		code:    http.StatusBadRequest,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/write.test/service.test?version=1",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/schemas/write.test",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "GET",
+		path:   "/schemas/write.test",
+		code:   http.StatusNotFound,
+	},
+}
+
+// revisionQueries expect the history of "write.test" config left by writeQueries and schemaQueries.
+var revisionQueries = []testQuery{
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test?revision=2",
+		code:   http.StatusOK,
+		data:   `{"host": "b", "port": "1", "extra": {"a": 1, "b": 2}}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test?revision=4",
+		code:   http.StatusNotFound,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test?at=2000-01-01T00:00:00Z",
+		code:   http.StatusNotFound,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test?at=yesterday",
+		code:   http.StatusBadRequest,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test/revisions",
+		code:   http.StatusOK,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test/revisions/100",
+		code:   http.StatusNotFound,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test/revisions/first",
+		code:   http.StatusBadRequest,
+	},
+	{
+		path: "/configs/write.test/service.test/revisions/3/restore",
+		code: http.StatusOK,
+		data: `{"host": "b", "user": "u", "extra": {"b": 2}}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test",
+		code:   http.StatusOK,
+		data:   `{"host": "b", "user": "u", "extra": {"b": 2}}`,
+	},
+	{
+		// the last removal
+		path: "/configs/write.test/service.test/revisions/8/restore",
+		code: http.StatusNoContent,
+	},
+	{
+		method: "GET",
+		path:   "/configs/write.test/service.test",
+		code:   http.StatusNotFound,
+	},
+}
 
+// checkQuery performs the query and checks the status code and the reply data,
+// it returns the reply headers for the checks of the particular tests.
+func checkQuery(t *testing.T, ts *httptest.Server, query testQuery) http.Header {
+	resp := sendQuery(t, ts, query)
 	defer resp.Body.Close()
+	// Requests without a body are identified by the method and the path in the messages.
+	if query.request == "" {
+		query.request = resp.Request.Method + " " + resp.Request.URL.RequestURI()
+	}
 
 	if resp.StatusCode != query.code {
 		t.Errorf("request '%v': unexpected status code %v(%v expected)", query.request, resp.StatusCode, query.code)
-		return
+		return resp.Header
 	}
 
-	if query.code != http.StatusOK {
+	if query.data == "" {
 		t.Logf("request '%v': passed", query.request)
-		return
+		return resp.Header
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -136,20 +1229,1704 @@ func checkQuery(t *testing.T, ts *httptest.Server, query testQuery) {
 	err = json.Unmarshal(body, &reply)
 	if err != nil {
 		t.Errorf("request '%v': failed to unmarshal reply: %v\nraw body:\n`%v`", query.request, err, string(body))
-		return
+		return resp.Header
 	}
 
 	err = json.Unmarshal([]byte(query.data), &expected)
 	if err != nil {
 		t.Errorf("request '%v': failed to unmarshal expected data: %v", query.request, err)
-		return
+		return resp.Header
 	}
 
 	if !reflect.DeepEqual(reply, expected) {
 		t.Errorf("request '%v': reply does not match expectations, raw reply:\n`%v`\nbut\n`%v`\nexpected",
 			query.request, string(body), query.data)
-		return
+		return resp.Header
 	}
 
 	t.Logf("request '%v': passed", query.request)
+	return resp.Header
+}
+
+// sendQuery performs the query without any checks, the caller closes the body of the reply.
+func sendQuery(t *testing.T, ts *httptest.Server, query testQuery) *http.Response {
+	if query.method == "" {
+		query.method = "POST"
+	}
+	if query.path == "" {
+		query.path = "/"
+	}
+
+	req, err := http.NewRequest(query.method, ts.URL+query.path, strings.NewReader(query.request))
+	if err != nil {
+		t.Fatalf("request '%v %v': failed to create http request: %v", query.method, query.path, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(secretsTokenHeader, testSecretsToken)
+	for key, value := range query.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request '%v %v': failed to perform http request: %v", query.method, query.path, err)
+	}
+	return resp
+}
+
+var fallbackQueries = []testQuery{
+	{
+		method: "GET",
+		path:   "/configs/rabbit.log/service.test.eu",
+		code:   http.StatusNotFound,
+	},
+	{
+		request: `{"Type": "rabbit.log", "Data": "service.test.eu", "Fallback": true}`,
+		code:    http.StatusOK,
+		data: `
+		{
+			"host": "10.0.5.42",
+			"port": "5671",
+			"virtualhost": "/",
+			"user": "guest",
+			"password": "guest"
+		}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs/rabbit.log/service.test.eu.1?fallback=true",
+		code:   http.StatusOK,
+	},
+	{
+		method: "GET",
+		path:   "/configs/rabbit.log/other.test?fallback=true",
+		code:   http.StatusNotFound,
+	},
+}
+
+func TestFallbackNames(t *testing.T) {
+	cases := map[string][]string{
+		"a.b.c":   {"a.b.c", "a.b", "a", "default"},
+		"a":       {"a", "default"},
+		"default": {"default"},
+	}
+	for name, expected := range cases {
+		names := fallbackNames(name)
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("fallback names of '%v' are %v, but %v expected", name, names, expected)
+		}
+	}
+}
+
+var layerQueries = []testQuery{
+	{
+		method:  "PUT",
+		path:    "/configs/layers.test/base",
+		request: `{"host": "localhost", "port": "5432", "options": {"ssl": true, "timeout": 10}, "tags": ["a"]}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/layers.test/prod",
+		request: `{"$extends": ["base"], "$abstract": true, "host": "prod.db", "options": {"timeout": null}}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/layers.test/service",
+		request: `{"$extends": ["prod"], "password": "secret", "tags": ["b"]}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method: "GET",
+		path:   "/configs/layers.test/service",
+		code:   http.StatusOK,
+		data:   `{"host": "prod.db", "port": "5432", "options": {"ssl": true}, "tags": ["b"], "password": "secret"}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs/layers.test/service/layers",
+		code:   http.StatusOK,
+		data: `
+		{
+			"layers": ["base", "prod", "service"],
+			"data": {"host": "prod.db", "port": "5432", "options": {"ssl": true}, "tags": ["b"], "password": "secret"},
+			"sources": {"host": "prod", "port": "base", "options.ssl": "base", "tags": "service", "password": "service"}
+		}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/layers.test/orphan",
+		request: `{"$extends": ["does.not.exist"]}`,
+		code:    http.StatusUnprocessableEntity,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/layers.test/base?version=1",
+		request: `{"$extends": ["service"]}`,
+		code:    http.StatusUnprocessableEntity,
+		data:    `{"error": "layers form a cycle: base -> service -> prod -> base"}`,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/layers.test/base?version=1",
+		code:   http.StatusUnprocessableEntity,
+		data:   `{"error": "config is a layer of prod"}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/schemas/layers.test",
+		request: `{"type": "object", "required": ["host"]}`,
+		code:    http.StatusCreated,
+	},
+	{
+		// The change of the layer is checked against the schema along with the configs extending it.
+		method:  "PUT",
+		path:    "/configs/layers.test/prod?version=1",
+		request: `{"$extends": ["base"], "$abstract": true, "host": null}`,
+		code:    http.StatusUnprocessableEntity,
+		data: `{
+			"error": "configs extending the layer do not match the schema",
+			"violations": {"service": ["$.host: required property is missing"]}
+		}`,
+	},
+	{
+		method: "DELETE",
+		path:   "/schemas/layers.test",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/layers.test/service?version=1",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/layers.test/prod?version=1",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/layers.test/base?version=1",
+		code:   http.StatusNoContent,
+	},
+}
+
+func TestMergeLayers(t *testing.T) {
+	layers := []layer{
+		{name: "base", data: map[string]interface{}{
+			"a": map[string]interface{}{"b": 1, "c": 2},
+			"d": []interface{}{1},
+		}},
+		{name: "env", data: map[string]interface{}{
+			extendsKey: []interface{}{"base"},
+			"a":        map[string]interface{}{"c": nil},
+			"d":        "replaced",
+		}},
+		{name: "service", data: map[string]interface{}{
+			"a": map[string]interface{}{"e": 3},
+		}},
+	}
+
+	sources := map[string]string{}
+	merged := mergeLayers(layers, sources)
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{"b": 1, "e": 3},
+		"d": "replaced",
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("merged data is %v, but %v expected", merged, expected)
+	}
+	expectedSources := map[string]string{"a.b": "base", "a.e": "service", "d": "env"}
+	if !reflect.DeepEqual(sources, expectedSources) {
+		t.Errorf("sources are %v, but %v expected", sources, expectedSources)
+	}
+}
+
+var refQueries = []testQuery{
+	{
+		method:  "PUT",
+		path:    "/configs/refs.test/service.test",
+		request: `{"dsn": "${database.postgres/service.test#host}:${database.postgres/service.test#port}", "rabbit": "${rabbit.log/service.test}"}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method: "GET",
+		path:   "/configs/refs.test/service.test",
+		code:   http.StatusOK,
+		data: `
+		{
+			"dsn": "localhost:5432",
+			"rabbit": {
+				"host": "10.0.5.42",
+				"port": "5671",
+				"virtualhost": "/",
+				"user": "guest",
+				"password": "guest"
+			}
+		}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/refs.test/dangling.test",
+		request: `{"host": "${database.postgres/does.not.exist#host}"}`,
+		code:    http.StatusUnprocessableEntity,
+		data:    `{"error": "referenced config does not exist", "reference": "${database.postgres/does.not.exist#host}"}`,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/refs.test/service.test?version=1",
+		request: `{"self": "${refs.test/service.test#self}"}`,
+		code:    http.StatusUnprocessableEntity,
+		data: `
+		{
+			"error": "references form a cycle: refs.test/service.test -> refs.test/service.test",
+			"reference": "${refs.test/service.test#self}"
+		}`,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/refs.test/service.test?version=1",
+		code:   http.StatusNoContent,
+	},
+}
+
+func TestResolveRefs(t *testing.T) {
+	configs := map[string]string{
+		"db/main":     `{"host": "h", "port": 5432, "options": {"ssl": true}}`,
+		"app/a":       `{"dsn": "${db/main#host}:${db/main#port}", "options": ["${db/main#options}"], "escaped": "$${db/main#host}"}`,
+		"app/loop":    `{"x": "${app/loop2#x}"}`,
+		"app/loop2":   `{"x": "${app/loop#x}"}`,
+		"app/missing": `{"x": "${db/main#user}"}`,
+	}
+	load := func(typ, name string) (*Config, error) {
+		data, ok := configs[typ+"/"+name]
+		if !ok {
+			return nil, nil
+		}
+		return &Config{Type: typ, Name: name, Data: toJsonb(data)}, nil
+	}
+	resolve := func(key string) (json.RawMessage, error) {
+		config, _ := load(strings.Split(key, "/")[0], strings.Split(key, "/")[1])
+		data, _, err := resolveData(config, load)
+		return data, err
+	}
+
+	data, err := resolve("app/a")
+	if err != nil {
+		t.Fatalf("failed to resolve references: %v", err)
+	}
+	var value, expected interface{}
+	json.Unmarshal(data, &value)
+	json.Unmarshal([]byte(`{"dsn": "h:5432", "options": [{"ssl": true}], "escaped": "${db/main#host}"}`), &expected)
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("resolved data is %s", data)
+	}
+
+	_, err = resolve("app/loop")
+	if rerr, ok := err.(*refError); !ok || rerr.msg != "references form a cycle: app/loop -> app/loop2 -> app/loop" {
+		t.Errorf("unexpected error of the cyclic references: %v", err)
+	}
+	_, err = resolve("app/missing")
+	if rerr, ok := err.(*refError); !ok || rerr.ref != "db/main#user" {
+		t.Errorf("unexpected error of the dangling reference: %v", err)
+	}
+}
+
+func TestSecretKeys(t *testing.T) {
+	oldKeys, err := parseSecretKeys("old:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("failed to parse keys: %v", err)
+	}
+	newKey := bytes.Repeat([]byte{1}, 32)
+	keys, err := parseSecretKeys("new:" + base64.StdEncoding.EncodeToString(newKey) + ",\n old:" +
+		base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("failed to parse keys: %v", err)
+	}
+
+	encrypted, err := oldKeys.encrypt("secret", "a/b")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, "$enc:v1:old:") {
+		t.Errorf("unexpected format of encrypted value '%v'", encrypted)
+	}
+	// The values encrypted before the rotation are still readable.
+	plain, err := keys.decrypt(encrypted, "a/b")
+	if err != nil || plain != "secret" {
+		t.Errorf("failed to decrypt value with the previous key: '%v', %v", plain, err)
+	}
+	_, err = keys.decrypt(encrypted, "a/c")
+	if err == nil {
+		t.Error("value of other config decrypted")
+	}
+
+	encrypted, err = keys.encrypt("secret", "a/b")
+	if err != nil || !strings.HasPrefix(encrypted, "$enc:v1:new:") {
+		t.Errorf("value is not encrypted with the current key: '%v', %v", encrypted, err)
+	}
+	_, err = oldKeys.decrypt(encrypted, "a/b")
+	if err == nil {
+		t.Error("value decrypted with unknown key")
+	}
+
+	for _, str := range []string{"", "nokey", "a:" + base64.StdEncoding.EncodeToString(make([]byte, 7))} {
+		if _, err := parseSecretKeys(str); err == nil {
+			t.Errorf("invalid keys '%v' parsed", str)
+		}
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	keys, err := parseSecretKeys("test:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("failed to parse keys: %v", err)
+	}
+	secretDB := db.Set(secretsSetting, keys)
+	defer db.Where("type = ?", "secrets.test").Delete(&Revision{})
+
+	config := &Config{
+		Type: "secrets.test",
+		Name: "service.test",
+		Data: toJsonb(`{"host": "localhost", "db_password": "secret", "nested": {"api_token": "token"}}`),
+	}
+	err = secretDB.Create(config).Error
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+	defer secretDB.Delete(config)
+	if !strings.Contains(string(config.Data.RawMessage), `"secret"`) {
+		t.Errorf("plaintext data is not restored after saving: %s", config.Data.RawMessage)
+	}
+
+	var stored []string
+	err = db.Raw(`SELECT data::text FROM configs WHERE type = 'secrets.test'
+		UNION ALL SELECT new_data::text FROM revisions WHERE type = 'secrets.test'`).Pluck("data", &stored).Error
+	if err != nil {
+		t.Fatalf("failed to load raw data: %v", err)
+	}
+	for _, data := range stored {
+		if strings.Contains(data, `"secret"`) || strings.Contains(data, `"token"`) || !strings.Contains(data, "localhost") {
+			t.Errorf("secret fields are not encrypted in the db: %v", data)
+		}
+	}
+
+	loaded := &Config{Type: "secrets.test", Name: "service.test"}
+	err = secretDB.First(loaded).Error
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	var data map[string]interface{}
+	json.Unmarshal(loaded.Data.RawMessage, &data)
+	if data["db_password"] != "secret" || data["nested"].(map[string]interface{})["api_token"] != "token" {
+		t.Errorf("secret fields are not decrypted: %s", loaded.Data.RawMessage)
+	}
+}
+
+func TestSecretMarks(t *testing.T) {
+	marks := secretMarks(map[string]interface{}{"properties": map[string]interface{}{
+		"dsn":  map[string]interface{}{"secret": true},
+		"list": map[string]interface{}{"items": map[string]interface{}{"properties": map[string]interface{}{"key": map[string]interface{}{"secret": true}}}},
+		"host": map[string]interface{}{"type": "string"},
+	}}, "")
+	if !reflect.DeepEqual(marks, []string{"dsn", "list[].key"}) {
+		t.Errorf("unexpected secret marks %v", marks)
+	}
+
+	keys, err := parseSecretKeys("test:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatalf("failed to parse keys: %v", err)
+	}
+	secretDB := db.Set(secretsSetting, keys)
+	defer db.Where("type = ?", "marks.test").Delete(&Revision{})
+
+	config := &Config{Type: "marks.test", Name: "service.test", Data: toJsonb(`{"dsn": "postgres://u:p@host/db"}`)}
+	err = secretDB.Create(config).Error
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+	defer secretDB.Delete(config)
+
+	// The stored values follow the secret marks of the schema.
+	marked := &Schema{Type: "marks.test", Document: toJsonb(`{"type": "object", "properties": {"dsn": {"secret": true}}}`)}
+	unmarked := &Schema{Type: "marks.test", Document: toJsonb(`{"type": "object", "properties": {"dsn": {"type": "string"}}}`)}
+	steps := []struct {
+		change    func() error
+		encrypted bool
+	}{
+		{func() error { return secretDB.Create(marked).Error }, true},
+		{func() error { return secretDB.Save(unmarked).Error }, false},
+		{func() error { return secretDB.Save(marked).Error }, true},
+		{func() error { return secretDB.Delete(&Schema{Type: "marks.test"}).Error }, false},
+	}
+	for i, step := range steps {
+		err := step.change()
+		if err != nil {
+			t.Fatalf("step %v: failed to change schema: %v", i, err)
+		}
+		var stored []string
+		err = db.Raw(`SELECT data::text FROM configs WHERE type = 'marks.test'
+			UNION ALL SELECT new_data::text FROM revisions WHERE type = 'marks.test'`).Pluck("data", &stored).Error
+		if err != nil {
+			t.Fatalf("step %v: failed to load raw data: %v", i, err)
+		}
+		for _, data := range stored {
+			if strings.Contains(data, encryptedPrefix) != step.encrypted {
+				t.Errorf("step %v: unexpected stored data %v", i, data)
+			}
+		}
+
+		loaded := &Config{Type: config.Type, Name: config.Name}
+		err = secretDB.First(loaded).Error
+		if err != nil || !strings.Contains(string(loaded.Data.RawMessage), "postgres://u:p@host/db") {
+			t.Errorf("step %v: unexpected config %s loaded: %v", i, loaded.Data.RawMessage, err)
+		}
+	}
+}
+
+func TestEncryptedPrefix(t *testing.T) {
+	for data, valid := range map[string]bool{
+		`{"note": "enc:x", "password": "p$enc:"}`:   true,
+		`{"note": "$enc:x"}`:                        false,
+		`{"list": [{"password": "$enc:v1:k:abc"}]}`: false,
+	} {
+		if err := checkPlaintext([]byte(data)); (err == nil) != valid {
+			t.Errorf("%v: unexpected check result %v", data, err)
+		}
+	}
+
+	ts := newTestServer()
+	defer ts.Close()
+	checkQuery(t, ts, testQuery{
+		method:  "PUT",
+		path:    "/configs/secrets.prefix/service.test",
+		request: `{"note": "$enc:x"}`,
+		code:    http.StatusBadRequest,
+	})
+
+	// The rows below are written bypassing the hooks, as they could be written before the check.
+	config := &Config{Type: "secrets.prefix", Name: "service.test", Data: toJsonb(`{"host": "localhost"}`)}
+	err := db.Create(config).Error
+	if err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+	setRaw := func(data string) {
+		err := db.Model(&Config{}).Where("type = ? AND name = ?", config.Type, config.Name).
+			UpdateColumn("data", toJsonb(data)).Error
+		if err == nil {
+			err = db.Model(&Revision{}).Where("type = ?", config.Type).UpdateColumn("new_data", toJsonb(data)).Error
+		}
+		if err != nil {
+			t.Fatalf("failed to write raw data: %v", err)
+		}
+	}
+	defer func() {
+		setRaw(`{"host": "localhost"}`)
+		db.Delete(config)
+		db.Where("type = ?", config.Type).Delete(&Revision{})
+	}()
+
+	store, err := newSnapshotStore(db, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+
+	// The config which can not be decrypted fails neither the change events nor the snapshot.
+	setRaw(`{"host": "localhost", "note": "$enc:x"}`)
+	err = db.First(&Config{Type: config.Type, Name: config.Name}).Error
+	if err == nil {
+		t.Error("broken encrypted value decrypted")
+	}
+	events, err := loadChangeEvents(db.Where("type = ?", config.Type))
+	if err != nil || len(events) != 1 || events[0].Action != actionCreated {
+		t.Errorf("unexpected change events %v: %v", events, err)
+	}
+	err = store.reload()
+	if err != nil {
+		t.Errorf("failed to reload snapshot: %v", err)
+	}
+	if snapshotted := store.get(config.Type, config.Name); snapshotted == nil || snapshotted.Data.RawMessage == nil {
+		t.Error("last good config is not kept in snapshot")
+	}
+}
+
+// unprivileged is the headers of the queries not authorized to read the secret fields.
+var unprivileged = map[string]string{secretsTokenHeader: ""}
+
+var maskQueries = []testQuery{
+	{
+		method:  "PUT",
+		path:    "/schemas/mask.test",
+		request: `{"type": "object", "properties": {"dsn": {"type": "string", "secret": true}}}`,
+		code:    http.StatusCreated,
+	},
+	{
+		method:  "PUT",
+		path:    "/configs/mask.test/service.test",
+		headers: unprivileged,
+		request: `{"dsn": "postgres://u:p@host/db", "user": "u", "DB_Password": "p", "auth": {"api_token": "t", "ttl": 10}, "list": [{"secret": 42}]}`,
+		code:    http.StatusCreated,
+		data:    `{"dsn": "****", "user": "u", "DB_Password": "****", "auth": {"api_token": "****", "ttl": 10}, "list": [{"secret": "****"}]}`,
+	},
+	{
+		method:  "GET",
+		path:    "/configs/mask.test/service.test",
+		headers: unprivileged,
+		code:    http.StatusOK,
+		data:    `{"dsn": "****", "user": "u", "DB_Password": "****", "auth": {"api_token": "****", "ttl": 10}, "list": [{"secret": "****"}]}`,
+	},
+	{
+		// The masked data read above must not overwrite the secrets.
+		method:  "PUT",
+		path:    "/configs/mask.test/service.test?version=1",
+		headers: unprivileged,
+		request: `{"dsn": "****", "user": "v", "DB_Password": "****", "auth": {"api_token": "****", "ttl": 10}, "list": [{"secret": "****"}]}`,
+		code:    http.StatusUnprocessableEntity,
+		data: `{
+			"error": "secret fields contain the masked value",
+			"fields": ["DB_Password", "auth.api_token", "dsn", "list[0].secret"]
+		}`,
+	},
+	{
+		method:  "PATCH",
+		path:    "/configs/mask.test/service.test?version=1",
+		headers: unprivileged,
+		request: `{"auth": {"api_token": "****"}}`,
+		code:    http.StatusUnprocessableEntity,
+		data:    `{"error": "secret fields contain the masked value", "fields": ["auth.api_token"]}`,
+	},
+	{
+		method: "GET",
+		path:   "/configs/mask.test/service.test",
+		code:   http.StatusOK,
+		data:   `{"dsn": "postgres://u:p@host/db", "user": "u", "DB_Password": "p", "auth": {"api_token": "t", "ttl": 10}, "list": [{"secret": 42}]}`,
+	},
+	{
+		path:    "/batch",
+		headers: unprivileged,
+		request: `[{"Type": "database.postgres", "Data": "service.test"}]`,
+		code:    http.StatusOK,
+		data: `[
+			{
+				"Type": "database.postgres",
+				"Data": "service.test",
+				"status": "found",
+				"config": {
+					"host": "localhost",
+					"port": "5432",
+					"database": "devdb",
+					"user": "mr_robot",
+					"password": "****",
+					"schema": "public"
+				}
+			}
+		]`,
+	},
+	{
+		method: "DELETE",
+		path:   "/configs/mask.test/service.test?version=1",
+		code:   http.StatusNoContent,
+	},
+	{
+		method: "DELETE",
+		path:   "/schemas/mask.test",
+		code:   http.StatusNoContent,
+	},
+}
+
+func TestMetadataView(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	// The secret fields are masked in the metadata view even for the authorized callers.
+	resp := sendQuery(t, ts, testQuery{method: "GET", path: "/configs/database.postgres/service.test?view=metadata"})
+	defer resp.Body.Close()
+
+	var reply struct {
+		Type    string
+		Name    string
+		Version int
+		Secrets []string
+		Data    map[string]interface{}
+	}
+	err := json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	if reply.Type != "database.postgres" || reply.Name != "service.test" || reply.Version == 0 {
+		t.Errorf("unexpected metadata: %+v", reply)
+	}
+	if !reflect.DeepEqual(reply.Secrets, []string{"password"}) || reply.Data["password"] != maskedValue ||
+		reply.Data["user"] != "mr_robot" {
+		t.Errorf("unexpected secrets %v and data %v", reply.Secrets, reply.Data)
+	}
+}
+
+func TestReferenceMasking(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	defer db.Where("type = ?", "refmask.test").Delete(&Revision{})
+	defer db.Delete(&Config{Type: "refmask.test", Name: "service.test"})
+
+	masked := `{
+		"db": "****",
+		"dsn": "****",
+		"host": "localhost",
+		"all": {"host": "localhost", "port": "5432", "database": "devdb", "user": "mr_robot", "password": "****", "schema": "public"}
+	}`
+	queries := []testQuery{
+		{
+			method: "PUT",
+			path:   "/configs/refmask.test/service.test",
+			request: `{
+				"db": "${database.postgres/service.test#password}",
+				"dsn": "mr_robot:${database.postgres/service.test#password}@localhost",
+				"host": "${database.postgres/service.test#host}",
+				"all": "${database.postgres/service.test}"
+			}`,
+			code: http.StatusCreated,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/refmask.test/service.test",
+			headers: unprivileged,
+			code:    http.StatusOK,
+			data:    masked,
+		},
+		{
+			method: "GET",
+			path:   "/configs/refmask.test/service.test",
+			code:   http.StatusOK,
+			data: `{
+				"db": "secret",
+				"dsn": "mr_robot:secret@localhost",
+				"host": "localhost",
+				"all": {"host": "localhost", "port": "5432", "database": "devdb", "user": "mr_robot", "password": "secret", "schema": "public"}
+			}`,
+		},
+		{
+			method:  "GET",
+			path:    "/watch/refmask.test/service.test?version=0",
+			headers: unprivileged,
+			code:    http.StatusOK,
+			data:    masked,
+		},
+		{
+			path:    "/batch",
+			headers: unprivileged,
+			request: `[{"Type": "refmask.test", "Data": "service.test"}]`,
+			code:    http.StatusOK,
+			data:    `[{"Type": "refmask.test", "Data": "service.test", "status": "found", "config": ` + masked + `}]`,
+		},
+	}
+	for _, query := range queries {
+		checkQuery(t, ts, query)
+	}
+
+	resp := sendQuery(t, ts, testQuery{method: "GET", path: "/configs/refmask.test/service.test?view=metadata"})
+	defer resp.Body.Close()
+	var reply struct {
+		Secrets []string
+		Data    map[string]interface{}
+	}
+	err := json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	if !reflect.DeepEqual(reply.Secrets, []string{"all.password", "db", "dsn"}) || reply.Data["db"] != maskedValue {
+		t.Errorf("unexpected secrets %v and data %v", reply.Secrets, reply.Data)
+	}
+
+	// The tag of the masked data must not depend on the hidden secrets.
+	headers := checkQuery(t, ts, testQuery{
+		method:  "GET",
+		path:    "/configs/refmask.test/service.test",
+		headers: map[string]string{secretsTokenHeader: ""},
+		code:    http.StatusOK,
+	})
+	if etag := headers.Get("ETag"); etag != dataETag(json.RawMessage(masked)) {
+		t.Errorf("ETag '%v' is not computed on the masked data", etag)
+	}
+	// The referenced configs may have been changed later than the config itself.
+	if modified := headers.Get("Last-Modified"); modified != "" {
+		t.Errorf("unexpected Last-Modified '%v' of the config with references", modified)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	token := &APIToken{Scopes: []string{"read:database.*:service.test", "write:rabbit.log:*", "secrets:rabbit.log:service.*", "bad"}}
+	token.AfterFind()
+	if len(token.scopes) != 3 {
+		t.Fatalf("unexpected parsed scopes: %+v", token.scopes)
+	}
+
+	checks := []struct {
+		access string
+		typ    string
+		name   string
+		allows bool
+	}{
+		{accessRead, "database.postgres", "service.test", true},
+		{accessRead, "database.postgres", "service.other", false},
+		{accessWrite, "database.postgres", "service.test", false},
+		{accessRead, "rabbit.log", "anything", true},
+		{accessWrite, "rabbit.log", "anything", true},
+		{accessSecrets, "rabbit.log", "anything", false},
+		{accessSecrets, "rabbit.log", "service.test", true},
+		{accessRead, "database", "service.test", false},
+	}
+	for _, check := range checks {
+		if token.allows(check.access, check.typ, check.name) != check.allows {
+			t.Errorf("%v access to %v/%v: %v expected", check.access, check.typ, check.name, check.allows)
+		}
+	}
+	if !token.allowsType(accessRead, "database.mysql") || token.allowsType(accessWrite, "database.mysql") {
+		t.Error("unexpected access to type")
+	}
+
+	// The metrics access does not include the read one.
+	scraper := &APIToken{Scopes: []string{"metrics:*:*"}}
+	scraper.AfterFind()
+	if !scraper.allowsAll(accessMetrics, "") || scraper.allows(accessRead, "database.postgres", "service.test") {
+		t.Errorf("unexpected access of the metrics scope: %+v", scraper.scopes)
+	}
+
+	for _, str := range []string{"read:a", "admin:a:b", "read::b", "read:[:b"} {
+		if _, err := parseScope(str); err == nil {
+			t.Errorf("invalid scope '%v' parsed", str)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	defer db.Where("owner LIKE ?", "auth.test.%").Delete(&APIToken{})
+	defer db.Where("type IN (?)", []string{"auth.test", "app.test", "auth.layers"}).Delete(&Revision{})
+
+	create := func(owner string, scopes ...string) map[string]string {
+		token, err := createToken(db, owner, time.Hour, scopes)
+		if err != nil {
+			t.Fatalf("failed to create token: %v", err)
+		}
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+	reader := create("auth.test.reader", "read:database.*:service.test")
+	writer := create("auth.test.writer", "write:auth.test:*")
+	schemaOwner := create("auth.test.schema.owner", "write:auth.test:*", "secrets:auth.test:*")
+	embedder := create("auth.test.embedder", "read:database.*:*", "write:app.*:*")
+	scraper := create("auth.test.scraper", "metrics:*:*")
+	layerOwner := create("auth.test.layer.owner", "secrets:auth.layers:*", "write:auth.layers:*")
+	// The secrets of the own config must not give the ones of its layers.
+	extender := create("auth.test.extender", "read:auth.layers:*", "write:auth.layers:mine", "secrets:auth.layers:mine")
+	expired := create("auth.test.expired", "read:*:*")
+	err := db.Model(&APIToken{}).Where("owner = ?", "auth.test.expired").
+		Update("expires_at", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatalf("failed to expire token: %v", err)
+	}
+
+	queries := []testQuery{
+		{
+			method: "GET",
+			path:   "/configs/database.postgres/service.test",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/database.postgres/service.test",
+			headers: map[string]string{"Authorization": "Bearer cfg_invalid"},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/database.postgres/service.test",
+			headers: expired,
+			code:    http.StatusUnauthorized,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/database.postgres/service.test",
+			headers: reader,
+			code:    http.StatusOK,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/rabbit.log/service.test",
+			headers: reader,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/database.postgres/service.test",
+			headers: reader,
+			request: `{}`,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/types?prefix=database.",
+			headers: reader,
+			code:    http.StatusOK,
+			data:    `{"items": ["database.postgres"]}`,
+		},
+		{
+			path:    "/batch",
+			headers: reader,
+			request: `[{"Type": "rabbit.log", "Data": "service.test"}]`,
+			code:    http.StatusOK,
+			data:    `[{"Type": "rabbit.log", "Data": "service.test", "status": "error", "error": "access denied"}]`,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/auth.test/service.test",
+			headers: writer,
+			request: `{"host": "${database.postgres/service.test#host}"}`,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/app.test/service.test",
+			headers: embedder,
+			request: `{"db": "${database.postgres/service.test#password}"}`,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/app.test/service.test",
+			headers: embedder,
+			request: `{"db": "${database.postgres/service.test}"}`,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/app.test/service.test",
+			headers: embedder,
+			request: `{"host": "${database.postgres/service.test#host}"}`,
+			code:    http.StatusCreated,
+		},
+		{
+			method:  "DELETE",
+			path:    "/configs/app.test/service.test?version=1",
+			headers: embedder,
+			code:    http.StatusNoContent,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/auth.test/service.test",
+			headers: writer,
+			request: `{"host": "localhost"}`,
+			code:    http.StatusCreated,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/auth.test/service.test/revisions/1",
+			headers: writer,
+			code:    http.StatusOK,
+		},
+		{
+			method:  "PUT",
+			path:    "/schemas/auth.test",
+			headers: writer,
+			request: `{"type": "object", "properties": {"dsn": {"type": "string", "secret": true}}}`,
+			code:    http.StatusCreated,
+		},
+		{
+			// The fields which are not secret anymore would be served in plaintext.
+			method:  "PUT",
+			path:    "/schemas/auth.test",
+			headers: writer,
+			request: `{"type": "object"}`,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "PUT",
+			path:    "/schemas/auth.test",
+			headers: writer,
+			request: `{"type": "object", "properties": {"dsn": {"type": "string", "secret": true}, "port": {"type": "integer"}}}`,
+			code:    http.StatusNoContent,
+		},
+		{
+			method:  "DELETE",
+			path:    "/schemas/auth.test",
+			headers: writer,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "DELETE",
+			path:    "/schemas/auth.test",
+			headers: schemaOwner,
+			code:    http.StatusNoContent,
+		},
+		{
+			method:  "DELETE",
+			path:    "/configs/auth.test/service.test?version=1",
+			headers: writer,
+			code:    http.StatusNoContent,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/auth.layers/prod",
+			headers: layerOwner,
+			request: `{"host": "h", "password": "p"}`,
+			code:    http.StatusCreated,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/auth.layers/mine",
+			headers: extender,
+			request: `{"$extends": ["prod"]}`,
+			code:    http.StatusForbidden,
+		},
+		{
+			// The own value overrides the secret of the layer.
+			method:  "PUT",
+			path:    "/configs/auth.layers/mine",
+			headers: extender,
+			request: `{"$extends": ["prod"], "password": "own"}`,
+			code:    http.StatusCreated,
+			data:    `{"$extends": ["prod"], "password": "own"}`,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/auth.layers/mine",
+			headers: extender,
+			code:    http.StatusOK,
+			data:    `{"host": "h", "password": "own"}`,
+		},
+		{
+			method:  "PUT",
+			path:    "/configs/auth.layers/mine?version=1",
+			headers: layerOwner,
+			request: `{"$extends": ["prod"]}`,
+			code:    http.StatusNoContent,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/auth.layers/mine",
+			headers: extender,
+			code:    http.StatusOK,
+			data:    `{"host": "h", "password": "****"}`,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/auth.layers/mine/layers",
+			headers: extender,
+			code:    http.StatusOK,
+			data: `{
+				"layers": ["prod", "mine"],
+				"data": {"host": "h", "password": "****"},
+				"sources": {"host": "prod", "password": "prod"}
+			}`,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/auth.layers/mine",
+			headers: layerOwner,
+			code:    http.StatusOK,
+			data:    `{"host": "h", "password": "p"}`,
+		},
+		{
+			method:  "DELETE",
+			path:    "/configs/auth.layers/mine?version=2",
+			headers: layerOwner,
+			code:    http.StatusNoContent,
+		},
+		{
+			method:  "DELETE",
+			path:    "/configs/auth.layers/prod?version=1",
+			headers: layerOwner,
+			code:    http.StatusNoContent,
+		},
+		{
+			// The counters include the sizes of the types.
+			method:  "GET",
+			path:    "/metrics",
+			headers: reader,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/stats/cache",
+			headers: reader,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/metrics",
+			headers: scraper,
+			code:    http.StatusOK,
+		},
+		{
+			method:  "GET",
+			path:    "/stats/lookups",
+			headers: scraper,
+			code:    http.StatusOK,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/database.postgres/service.test",
+			headers: scraper,
+			code:    http.StatusForbidden,
+		},
+	}
+
+	r := gin.New()
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	server := newConfigServer(db, cache)
+	r.Use(recovery, server.authenticate)
+	server.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, query := range queries {
+		checkQuery(t, ts, query)
+	}
+
+	// The owner of the token is recorded as the author.
+	var authors []string
+	err = db.Model(&Revision{}).Where("type = ?", "auth.test").Pluck("DISTINCT author", &authors).Error
+	if err != nil || !reflect.DeepEqual(authors, []string{"auth.test.writer"}) {
+		t.Errorf("unexpected authors of revisions %v: %v", authors, err)
+	}
+}
+
+func TestClientIdentities(t *testing.T) {
+	identities, err := parseIdentities(strings.NewReader(`
+		# billing service
+		billing read:*:*.billing
+		spiffe://cluster/ns/ops read:*:* write:ops.*:*
+	`))
+	if err != nil {
+		t.Fatalf("failed to parse identities: %v", err)
+	}
+
+	uri, _ := url.Parse("spiffe://cluster/ns/ops")
+	checks := []struct {
+		cert   *x509.Certificate
+		owner  string
+		access string
+		typ    string
+		name   string
+		allows bool
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}, "cert:billing", accessRead, "database.postgres", "service.billing", true},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}, "cert:billing", accessRead, "database.postgres", "service.test", false},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "other"}, DNSNames: []string{"billing"}}, "cert:billing", accessWrite, "database.postgres", "service.billing", false},
+		{&x509.Certificate{URIs: []*url.URL{uri}}, "cert:spiffe://cluster/ns/ops", accessWrite, "ops.deploy", "service.test", true},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "other"}}, "", "", "", "", false},
+	}
+	for _, check := range checks {
+		token := identities.certToken(check.cert)
+		switch {
+		case token == nil && check.owner != "":
+			t.Errorf("certificate of %v is not mapped", check.owner)
+		case token == nil:
+		case token.Owner != check.owner:
+			t.Errorf("certificate mapped to %v(%v expected)", token.Owner, check.owner)
+		case token.allows(check.access, check.typ, check.name) != check.allows:
+			t.Errorf("%v: %v access to %v/%v: %v expected", check.owner, check.access, check.typ, check.name, check.allows)
+		}
+	}
+
+	for _, str := range []string{"billing read:a", "a read:*:*\na read:*:*"} {
+		if _, err := parseIdentities(strings.NewReader(str)); err == nil {
+			t.Errorf("invalid identities '%v' parsed", str)
+		}
+	}
+}
+
+// newTestCert issues a certificate with the common name signed by the parent, self-signed if the parent is nil.
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil)
+	billing := newTestCert(t, "billing", &ca)
+	unknown := newTestCert(t, "unknown", &ca)
+
+	r := gin.New()
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	server := newConfigServer(db, cache)
+	var err error
+	server.identities, err = parseIdentities(strings.NewReader("billing read:*:service.test"))
+	if err != nil {
+		t.Fatalf("failed to parse identities: %v", err)
+	}
+	r.Use(recovery, server.authenticate)
+	server.register(r)
+
+	ts := httptest.NewUnstartedServer(r)
+	ts.TLS = &tls.Config{
+		ClientCAs:  x509.NewCertPool(),
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	ts.TLS.ClientCAs.AddCert(ca.Leaf)
+	ts.StartTLS()
+	defer ts.Close()
+
+	checks := []struct {
+		cert *tls.Certificate
+		path string
+		code int
+	}{
+		{nil, "/configs/database.postgres/service.test", http.StatusUnauthorized},
+		{&unknown, "/configs/database.postgres/service.test", http.StatusUnauthorized},
+		{&billing, "/configs/database.postgres/service.test", http.StatusOK},
+		{&billing, "/configs/database.postgres/service.other", http.StatusForbidden},
+	}
+	for _, check := range checks {
+		transport := ts.Client().Transport.(*http.Transport).Clone()
+		if check.cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*check.cert}
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL + check.path)
+		if err != nil {
+			t.Fatalf("failed to perform http request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != check.code {
+			t.Errorf("%v: unexpected status code %v(%v expected)", check.path, resp.StatusCode, check.code)
+		}
+	}
+}
+
+func TestRoleRules(t *testing.T) {
+	writer, err := parseRules([]byte(`[
+		{"effect": "allow", "actions": ["read", "write"], "type": "*", "name": "*"},
+		{"effect": "deny", "actions": ["*"], "type": "database.*", "name": "*.prod"}
+	]`))
+	if err != nil {
+		t.Fatalf("failed to parse rules: %v", err)
+	}
+	token := &APIToken{scopes: []scope{{accessRead, "database.postgres", "service.prod"}}}
+	for _, rule := range writer {
+		token.rules = append(token.rules, boundRule{rule, "writer", RoleBinding{ID: 1, TypeGlob: "*", NameGlob: "service.*"}})
+	}
+
+	checks := []struct {
+		access string
+		typ    string
+		name   string
+		allows bool
+	}{
+		{accessWrite, "rabbit.log", "service.test", true},
+		{accessSecrets, "rabbit.log", "service.test", false},
+		// Out of the binding scope.
+		{accessWrite, "rabbit.log", "billing.test", false},
+		// Deny overrides the scope of the token.
+		{accessRead, "database.postgres", "service.prod", false},
+		{accessRead, "database.postgres", "service.test", true},
+	}
+	for _, check := range checks {
+		if token.allows(check.access, check.typ, check.name) != check.allows {
+			t.Errorf("%v access to %v/%v: %v expected", check.access, check.typ, check.name, check.allows)
+		}
+	}
+	if !token.allowsType(accessWrite, "rabbit.log") || token.allowsType(accessSecrets, "rabbit.log") {
+		t.Error("unexpected access to type")
+	}
+
+	// The access to all configs of the type requires the grants covering all the names and no denials.
+	schemas, err := parseRules([]byte(`[
+		{"effect": "allow", "actions": ["write"], "type": "db", "name": "*"},
+		{"effect": "deny", "actions": ["write"], "type": "db", "name": "prod"}
+	]`))
+	if err != nil {
+		t.Fatalf("failed to parse rules: %v", err)
+	}
+	owner := &APIToken{Scopes: []string{"write:db:?", "write:cache:*", "write:queue.*:*", "metrics:*:?"}}
+	owner.AfterFind()
+	for _, rule := range schemas {
+		owner.rules = append(owner.rules, boundRule{rule, "schemas", RoleBinding{ID: 2, TypeGlob: "*", NameGlob: "*"}})
+	}
+	typeChecks := []struct {
+		access string
+		typ    string
+		allows bool
+	}{
+		// The deny rule of a single name refuses the access to the whole type.
+		{accessWrite, "db", false},
+		{accessWrite, "cache", true},
+		{accessWrite, "queue.jobs", true},
+		// The scope of the types matching the glob does not cover all types.
+		{accessWrite, "", false},
+		{accessMetrics, "", false},
+	}
+	for _, check := range typeChecks {
+		if owner.allowsAll(check.access, check.typ) != check.allows {
+			t.Errorf("%v access to all configs of type '%v': %v expected", check.access, check.typ, check.allows)
+		}
+	}
+
+	for _, str := range []string{`{}`, `[{"effect": "maybe", "actions": ["read"], "type": "*", "name": "*"}]`,
+		`[{"effect": "allow", "actions": [], "type": "*", "name": "*"}]`,
+		`[{"effect": "allow", "actions": ["drop"], "type": "*", "name": "*"}]`,
+		`[{"effect": "allow", "actions": ["read"], "type": "[", "name": "*"}]`} {
+		if _, err := parseRules([]byte(str)); err == nil {
+			t.Errorf("invalid rules '%v' parsed", str)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	defer db.Where("owner LIKE ?", "rbac.test.%").Delete(&APIToken{})
+	defer db.Where("principal LIKE ?", "rbac.test.%").Delete(&RoleBinding{})
+	defer db.Delete(&Role{Name: "rbac.test.no-prod"})
+
+	err := setRole(db, "rbac.test.no-prod", `[{"effect": "deny", "actions": ["*"], "type": "*", "name": "*.prod"}]`)
+	if err != nil {
+		t.Fatalf("failed to set role: %v", err)
+	}
+	for _, binding := range [][]string{
+		{"rbac.test.team", "reader", "database.*", "*"},
+		{"rbac.test.team", "rbac.test.no-prod", "*", "*"},
+		{"rbac.test.admin", "admin", "*", "*"},
+		{"rbac.test.auditor", "admin", "*", "*"},
+		{"rbac.test.auditor", "rbac.test.no-prod", "*", "*"},
+	} {
+		_, err := bindRole(db, binding[0], binding[1], binding[2], binding[3])
+		if err != nil {
+			t.Fatalf("failed to bind role: %v", err)
+		}
+	}
+	auth := func(owner string) map[string]string {
+		token, err := createToken(db, owner, time.Hour, nil)
+		if err != nil {
+			t.Fatalf("failed to create token: %v", err)
+		}
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+	team, admin, auditor := auth("rbac.test.team"), auth("rbac.test.admin"), auth("rbac.test.auditor")
+	_, err = createToken(db, "rbac.test.scoped", time.Hour, []string{"write:rabbit.*:*"})
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+
+	queries := []testQuery{
+		{
+			method:  "GET",
+			path:    "/configs/database.postgres/service.test",
+			headers: team,
+			code:    http.StatusOK,
+		},
+		{
+			method:  "GET",
+			path:    "/configs/rabbit.log/service.test",
+			headers: team,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/explain?principal=rbac.test.admin&type=database.postgres&name=service.test",
+			headers: team,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/explain?principal=rbac.test.team&action=write&type=database.postgres&name=service.test",
+			headers: admin,
+			code:    http.StatusOK,
+		},
+		{
+			// The scopes of the explained principal's tokens are considered, the write one includes the read.
+			method:  "GET",
+			path:    "/explain?principal=rbac.test.scoped&type=rabbit.log&name=service.test",
+			headers: admin,
+			code:    http.StatusOK,
+			data: `{
+				"principal": "rbac.test.scoped",
+				"action": "read",
+				"type": "rabbit.log",
+				"name": "service.test",
+				"allowed": true,
+				"reason": "allowed by scope write:rabbit.*:*",
+				"rules": [],
+				"scopes": [{"scope": "write:rabbit.*:*", "matched": true}]
+			}`,
+		},
+		{
+			method:  "GET",
+			path:    "/audit?limit=1",
+			headers: admin,
+			code:    http.StatusOK,
+		},
+		{
+			// The records of all configs include the ones of the denied names.
+			method:  "GET",
+			path:    "/audit?limit=1",
+			headers: auditor,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/audit?type=database.postgres&limit=1",
+			headers: auditor,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/audit?name=service.test&limit=1",
+			headers: auditor,
+			code:    http.StatusForbidden,
+		},
+		{
+			method:  "GET",
+			path:    "/audit?type=database.postgres&name=service.test&limit=1",
+			headers: auditor,
+			code:    http.StatusOK,
+		},
+	}
+
+	r := gin.New()
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	server := newConfigServer(db, cache)
+	r.Use(recovery, server.authenticate)
+	server.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for _, query := range queries {
+		checkQuery(t, ts, query)
+	}
+
+	resp := sendQuery(t, ts, testQuery{method: "GET", path: "/explain?type=database.postgres&name=service.prod", headers: team})
+	defer resp.Body.Close()
+
+	var reply struct {
+		Principal string
+		Allowed   bool
+		Reason    string
+		Rules     []struct {
+			Role    string
+			Effect  string
+			Matched bool
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	if reply.Principal != "rbac.test.team" || reply.Allowed || !strings.HasPrefix(reply.Reason, "denied by role 'rbac.test.no-prod'") {
+		t.Errorf("unexpected explanation: %+v", reply)
+	}
+	if len(reply.Rules) != 2 || !reply.Rules[0].Matched || !reply.Rules[1].Matched || reply.Rules[1].Effect != effectDeny {
+		t.Errorf("unexpected explained rules: %+v", reply.Rules)
+	}
+}
+
+func TestRuleActions(t *testing.T) {
+	rules := []struct {
+		rule    roleRule
+		action  string
+		applies bool
+	}{
+		{roleRule{Effect: effectAllow, Actions: []string{accessRead}}, accessRead, true},
+		{roleRule{Effect: effectAllow, Actions: []string{accessRead}}, accessWrite, false},
+		{roleRule{Effect: effectAllow, Actions: []string{accessWrite}}, accessRead, true},
+		{roleRule{Effect: effectAllow, Actions: []string{accessSecrets}}, accessRead, true},
+		{roleRule{Effect: effectAllow, Actions: []string{accessWrite}}, accessSecrets, false},
+		{roleRule{Effect: effectAllow, Actions: []string{"*"}}, accessAdmin, true},
+		{roleRule{Effect: effectDeny, Actions: []string{accessWrite}}, accessRead, false},
+		{roleRule{Effect: effectDeny, Actions: []string{accessWrite}}, accessWrite, true},
+	}
+	for _, r := range rules {
+		if r.rule.hasAction(r.action) != r.applies {
+			t.Errorf("%v rule of %v: applies to %v is %v", r.rule.Effect, r.rule.Actions, r.action, !r.applies)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	r := gin.New()
+	r.Use(recovery)
+	r.GET("/panic", func(*gin.Context) {
+		panic("handler failed")
+	})
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	checkQuery(t, ts, testQuery{
+		method:  "GET",
+		path:    "/panic",
+		headers: map[string]string{"Authorization": "Bearer cfg_recovery"},
+		code:    http.StatusInternalServerError,
+	})
+	out := logged.String()
+	if !strings.Contains(out, "handler failed") {
+		t.Errorf("panic is not logged: %v", out)
+	}
+	if strings.Contains(out, "cfg_recovery") || strings.Contains(out, testSecretsToken) {
+		t.Errorf("tokens of the request are logged: %v", out)
+	}
+}
+
+func TestAuditBuffer(t *testing.T) {
+	audit := newAuditLog(nil, 0)
+	// Nothing writes the records, the overflow is dropped instead of blocking.
+	for i := 0; i <= auditBuffer; i++ {
+		audit.add(AuditRecord{Status: http.StatusOK})
+	}
+	if audit.dropped != 1 || len(audit.records) != auditBuffer {
+		t.Errorf("unexpected %v dropped and %v buffered records", audit.dropped, len(audit.records))
+	}
+
+	outcomes := map[int]string{
+		http.StatusOK:                  outcomeSuccess,
+		http.StatusNotModified:         outcomeSuccess,
+		http.StatusNotFound:            outcomeRejected,
+		http.StatusUnauthorized:        outcomeDenied,
+		http.StatusForbidden:           outcomeDenied,
+		http.StatusInternalServerError: outcomeError,
+	}
+	for status, outcome := range outcomes {
+		if auditOutcome(status) != outcome {
+			t.Errorf("status %v: outcome %v(%v expected)", status, auditOutcome(status), outcome)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	start := time.Now().Add(-time.Second)
+	r := gin.New()
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	server := newConfigServer(db, cache)
+	server.auditLog = newAuditLog(db, 0)
+	go server.auditLog.run()
+	r.Use(recovery, server.audit, secretsAccess(testSecretsToken))
+	server.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	queries := []testQuery{
+		{
+			request: `{"Type": "database.postgres", "Data": "service.test"}`,
+			code:    http.StatusOK,
+		},
+		{
+			// The forwarding headers do not change the recorded address.
+			method:  "GET",
+			path:    "/configs/database.postgres/service.audit",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7", "X-Real-Ip": "203.0.113.7"},
+			code:    http.StatusNotFound,
+		},
+		{
+			// Every item of the batch is recorded separately.
+			path: "/batch",
+			request: `[
+				{"Type": "database.postgres", "Data": "service.test"},
+				{"Type": "database.postgres", "Data": "service.audit.batch"}
+			]`,
+			code: http.StatusOK,
+		},
+	}
+	for _, query := range queries {
+		checkQuery(t, ts, query)
+	}
+	server.auditLog.flush()
+
+	resp, err := http.Get(ts.URL + "/audit?type=database.postgres&since=" + url.QueryEscape(start.Format(time.RFC3339)))
+	if err != nil {
+		t.Fatalf("failed to perform http request: %v", err)
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Items []AuditRecord
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+
+	var found []string
+	for _, record := range reply.Items {
+		if record.Principal == "anonymous" && record.Action == accessRead {
+			found = append(found, record.Name+" "+record.Outcome)
+			if record.ClientIP != "127.0.0.1" {
+				t.Errorf("unexpected client address %v of record %v", record.ClientIP, record.ID)
+			}
+		}
+	}
+	// The newest records go first.
+	expected := []string{
+		"service.audit.batch " + outcomeRejected,
+		"service.test " + outcomeSuccess,
+		"service.audit " + outcomeRejected,
+		"service.test " + outcomeSuccess,
+	}
+	if len(found) < len(expected) || !reflect.DeepEqual(found[:len(expected)], expected) {
+		t.Errorf("unexpected audit records %v(%v expected)", found, expected)
+	}
+
+	err = db.Model(&AuditRecord{}).Where("name = ?", "service.audit").Update("outcome", outcomeSuccess).Error
+	if err == nil {
+		t.Error("audit record updated")
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	m := newMetrics()
+	r := gin.New()
+	r.Use(configServer{metrics: m}.instrument)
+	r.GET("/configs/:type/:name", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	m.setRoutes(r.Routes())
+	for _, path := range []string{"/configs/database.postgres/service.test", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	m.observeQuery("query", 20*time.Millisecond, nil)
+	m.observeQuery("query", 2*time.Millisecond, errors.New("connection refused"))
+	m.observeQuery("query", time.Millisecond, gorm.ErrRecordNotFound)
+
+	var buf bytes.Buffer
+	m.write(metricsWriter{&buf})
+	metricsWriter{&buf}.sample("escaped", []string{"label", "a\"b\\c\nd"}, 1.5)
+	expected := []string{
+		`# TYPE config_http_requests_total counter`,
+		`config_http_requests_total{method="GET",route="/configs/:type/:name",status="204"} 1`,
+		`config_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`# TYPE config_http_request_duration_seconds histogram`,
+		`config_http_request_duration_seconds_count{method="GET",route="/configs/:type/:name"} 1`,
+		`config_db_query_duration_seconds_bucket{operation="query",le="0.005"} 2`,
+		`config_db_query_duration_seconds_bucket{operation="query",le="0.025"} 3`,
+		`config_db_query_duration_seconds_bucket{operation="query",le="+Inf"} 3`,
+		`config_db_query_duration_seconds_sum{operation="query"} 0.023`,
+		`config_db_errors_total{operation="query"} 1`,
+		`escaped{label="a\"b\\c\nd"} 1.5`,
+	}
+	lines := strings.Split(buf.String(), "\n")
+	for _, line := range expected {
+		found := false
+		for _, l := range lines {
+			found = found || l == line
+		}
+		if !found {
+			t.Errorf("line %v not found in metrics:\n%v", line, buf.String())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	r := gin.New()
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	server := newConfigServer(db, cache)
+	server.metrics = newMetrics()
+	instrumentDB(db, server.metrics)
+	r.Use(server.instrument)
+	server.register(r)
+	server.metrics.setRoutes(r.Routes())
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/configs/database.postgres/service.test", nil))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %v", w.Code)
+	}
+
+	var rows int
+	err := db.Model(&Config{}).Count(&rows).Error
+	if err != nil {
+		t.Fatalf("failed to count configs: %v", err)
+	}
+	for _, line := range []string{
+		`config_http_requests_total{method="GET",route="/configs/:type/:name",status="200"} 1`,
+		`config_cache_misses_total 1`,
+		`config_cache_hit_ratio 0`,
+		`config_db_query_duration_seconds_count{operation="query"}`,
+		fmt.Sprintf("config_configs_rows %v", rows),
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("%v not found in metrics:\n%v", line, w.Body.String())
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	r := gin.New()
+	cache := newConfigCache(defaultCacheSize, defaultCacheTTL, defaultCacheNegativeTTL)
+	server := newConfigServer(db, cache)
+	server.registerHealth(r)
+	// The probes are registered before the authentication, so they need no token.
+	r.Use(server.authenticate)
+	server.register(r)
+
+	closed, err := gorm.Open("postgres", dbConfig)
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	closed.Close()
+	broken := gin.New()
+	(&configServer{db: closed}).registerHealth(broken)
+
+	tests := []struct {
+		r      *gin.Engine
+		path   string
+		code   int
+		status string
+		checks map[string]string
+	}{
+		{r, "/healthz", http.StatusOK, checkOK, map[string]string{"process": checkOK}},
+		{r, "/readyz", http.StatusOK, checkOK, map[string]string{"database": checkOK, "migrations": checkOK}},
+		{broken, "/healthz", http.StatusOK, checkOK, map[string]string{"process": checkOK}},
+		{broken, "/readyz", http.StatusServiceUnavailable, checkFailed, map[string]string{"database": checkFailed, "migrations": checkSkipped}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		test.r.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		var reply struct {
+			Status string
+			Checks []healthCheck
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &reply)
+		if err != nil {
+			t.Errorf("%v: failed to decode reply: %v", test.path, err)
+			continue
+		}
+		checks := map[string]string{}
+		for _, check := range reply.Checks {
+			checks[check.Name] = check.Status
+			// The probes are anonymous, so the details of the failures are not disclosed.
+			if check.Status == checkFailed && check.Error != check.Name+" check failed" {
+				t.Errorf("%v: unexpected error '%v' of the %v check", test.path, check.Error, check.Name)
+			}
+		}
+		if w.Code != test.code || reply.Status != test.status || !reflect.DeepEqual(checks, test.checks) {
+			t.Errorf("%v: unexpected reply %v %v(%v %v expected)", test.path, w.Code, w.Body.String(), test.code, test.checks)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/types", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %v of the authenticated route", w.Code)
+	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// defaultSnapshotRefresh is the default period of the snapshot reloading.
+const defaultSnapshotRefresh = time.Minute
+
+// configSnapshot is an immutable copy of the whole configs table.
+type configSnapshot struct {
+	configs  map[cacheKey]*Config
+	loadedAt time.Time
+}
+
+// snapshotStore serves the configs from the snapshot loaded into memory.
+// A fresh snapshot is loaded periodically and on the changes in the feed,
+// the last good one keeps being served if the loading fails.
+type snapshotStore struct {
+	db      *gorm.DB
+	refresh time.Duration
+	current atomic.Value // *configSnapshot
+
+	// mu serializes the loading, so an older snapshot does not replace a newer one.
+	mu sync.Mutex
+}
+
+// newSnapshotStore loads the initial snapshot.
+func newSnapshotStore(db *gorm.DB, refresh time.Duration) (*snapshotStore, error) {
+	store := &snapshotStore{
+		db:      db,
+		refresh: refresh,
+	}
+	return store, store.reload()
+}
+
+// get returns the config from the current snapshot, it is nil for the missing config.
+func (store *snapshotStore) get(typ, name string) *Config {
+	return store.current.Load().(*configSnapshot).configs[cacheKey{typ, name}]
+}
+
+// reload replaces the current snapshot with the actual state of the table.
+func (store *snapshotStore) reload() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// The rows are scanned one by one bypassing the hooks, so a single config which can not be decrypted
+	// does not fail the whole reloading.
+	rows, err := store.db.Model(&Config{}).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	previous, _ := store.current.Load().(*configSnapshot)
+	snapshot := &configSnapshot{
+		configs:  make(map[cacheKey]*Config),
+		loadedAt: time.Now(),
+	}
+	for rows.Next() {
+		config := &Config{}
+		err = store.db.ScanRows(rows, config)
+		if err != nil {
+			return err
+		}
+		key := cacheKey{config.Type, config.Name}
+		err = config.AfterFind(store.db)
+		if err != nil {
+			// The last good copy of the config keeps being served.
+			log.Printf("failed to load config '%v' with type '%v' into snapshot: %v", config.Name, config.Type, err)
+			if previous == nil || previous.configs[key] == nil {
+				continue
+			}
+			config = previous.configs[key]
+		}
+		snapshot.configs[key] = config
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	store.current.Store(snapshot)
+	return nil
+}
+
+// follow reloads the snapshot on the changes in the feed and on the refresh interval until the process exits.
+func (store *snapshotStore) follow(feed *changeFeed) {
+	ticker := time.NewTicker(store.refresh)
+	defer ticker.Stop()
+
+	var events <-chan changeEvent
+	for {
+		if events == nil {
+			events = feed.subscribe(func(changeEvent) bool {
+				return true
+			}).events
+		}
+
+		select {
+		case _, open := <-events:
+			// The pending events are covered by the same reload.
+			if !open || !drainEvents(events) {
+				// Some events may be missed, so the reload is still required.
+				events = nil
+			}
+		case <-ticker.C:
+		}
+
+		err := store.reload()
+		if err != nil {
+			log.Printf("failed to reload configs snapshot, serving the one loaded at %v: %v",
+				store.current.Load().(*configSnapshot).loadedAt, err)
+		}
+	}
+}
+
+// drainEvents skips the pending events, it returns false if the channel is closed.
+func drainEvents(events <-chan changeEvent) bool {
+	for {
+		select {
+		case _, open := <-events:
+			if !open {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// clientIdentities maps the identities of the client certificates to the scopes of the clients.
+// The clients are the principals `cert:<identity>` for the role bindings.
+type clientIdentities map[string][]scope
+
+// parseIdentities parses the mapping of the client certificate identities: one identity per line
+// followed by its scopes separated by spaces, e.g. `billing read:*:*.billing`.
+// The identities without scopes get the access by the roles bound to `cert:<identity>` only.
+// Empty lines and lines starting with # are skipped.
+func parseIdentities(r io.Reader) (clientIdentities, error) {
+	identities := clientIdentities{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := identities[fields[0]]; ok {
+			return nil, fmt.Errorf("line %v: duplicate identity '%v'", line, fields[0])
+		}
+		identities[fields[0]] = []scope{}
+		for _, str := range fields[1:] {
+			sc, err := parseScope(str)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+			identities[fields[0]] = append(identities[fields[0]], sc)
+		}
+	}
+	return identities, scanner.Err()
+}
+
+// certToken returns the token with the scopes of the first mapped identity of the certificate,
+// the common name goes first, then the DNS names, emails and URIs of the subject alternative names.
+// It returns nil if none of the identities is mapped.
+func (identities clientIdentities) certToken(cert *x509.Certificate) *APIToken {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, name := range names {
+		if scopes, ok := identities[name]; ok && name != "" {
+			// The token is not stored, it just carries the identity and the scopes of the client.
+			return &APIToken{
+				Owner:  "cert:" + name,
+				scopes: scopes,
+			}
+		}
+	}
+	return nil
+}
+
+// loadTLSConfig builds the TLS config of the server from the environment variables:
+// TEST_CONFIG_TLS_CLIENT_CA is the bundle of CA certificates verifying the client certificates,
+// which are required unless TEST_CONFIG_TLS_CLIENT_AUTH is `optional`.
+// The client certificates are not requested if the bundle is not set.
+func loadTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	path := os.Getenv("TEST_CONFIG_TLS_CLIENT_CA")
+	if path == "" {
+		return config, nil
+	}
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in client CA bundle")
+	}
+
+	switch mode := os.Getenv("TEST_CONFIG_TLS_CLIENT_AUTH"); mode {
+	case "", "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client auth mode '%v'", mode)
+	}
+	return config, nil
+}
+
+// loadIdentities loads the mapping of the client certificate identities from the file
+// named by TEST_CONFIG_TLS_IDENTITIES, it returns nil if the variable is not set.
+func loadIdentities() (clientIdentities, error) {
+	path := os.Getenv("TEST_CONFIG_TLS_IDENTITIES")
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseIdentities(file)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Timeouts of the watch requests.
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
+// handleWatch blocks until the config differs from the state the client has already seen:
+// `GET /watch/:type/:name?version=...&timeout=...`.
+// The seen state is passed as the version(0 for the missing config) or as the ETag in If-None-Match.
+// The reply is the same as for the lookup, 304 is returned if nothing changed before the timeout.
+func (s configServer) handleWatch(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessRead, typ, name) {
+		return
+	}
+
+	timeout := defaultWatchTimeout
+	if str := c.Query("timeout"); str != "" {
+		var err error
+		timeout, err = time.ParseDuration(str)
+		if err != nil || timeout <= 0 || timeout > maxWatchTimeout {
+			log.Printf("invalid watch timeout '%v'", str)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid timeout",
+			})
+			return
+		}
+	}
+
+	seenETag := c.GetHeader("If-None-Match")
+	seenVersion, err := strconv.Atoi(c.DefaultQuery("version", "0"))
+	if err != nil || (seenETag == "" && c.Query("version") == "") {
+		log.Println("watch request without valid version or If-None-Match")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "version or If-None-Match required",
+		})
+		return
+	}
+	// seenData is the tag of the data at the seen version when the watch started.
+	var seenData string
+	// data is the data of the loaded config as it is served to the caller.
+	changed := func(config *Config, data []byte) bool {
+		switch {
+		case seenETag != "" && config == nil:
+			return true
+		case seenETag != "":
+			return !etagMatches(seenETag, dataETag(data))
+		case config == nil:
+			return seenVersion != 0
+		case config.Version != seenVersion:
+			return true
+		default:
+			// The changes of the layers and the referenced configs do not bump the version,
+			// so the data is compared as well.
+			etag := dataETag(data)
+			if seenData == "" {
+				seenData = etag
+			}
+			return etag != seenData
+		}
+	}
+
+	// The subscription goes first, so the changes made after the check below are not missed.
+	// Other configs of the type may be the layers of the watched one,
+	// configs of any type may be referenced by it.
+	var followAll int32
+	sub := s.feed.subscribe(func(event changeEvent) bool {
+		return event.Type == typ || atomic.LoadInt32(&followAll) != 0
+	})
+	defer sub.close()
+	events := sub.events
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		config, ok := s.loadConfig(c, typ, name)
+		if !ok {
+			return
+		}
+		var data json.RawMessage
+		if config != nil {
+			if hasLayers(config.Data.RawMessage) || hasRefs(config.Data.RawMessage) {
+				atomic.StoreInt32(&followAll, 1)
+			}
+			// The layers and the references are loaded bypassing the cache, which may not be invalidated yet.
+			var err error
+			data, _, _, err = resolveMasked(config, txLoader(s.db), s.referenceMask(c, false))
+			if err != nil {
+				replyResolveError(c, typ, name, err)
+				return
+			}
+			// The tags are computed on the masked data, so they disclose nothing about the hidden secrets.
+			data, ok = s.visibleData(c, typ, name, data)
+			if !ok {
+				return
+			}
+		}
+		if changed(config, data) {
+			if config == nil {
+				replyNotFound(c, typ, name)
+				return
+			}
+			c.Header("ETag", dataETag(data))
+			c.Header(versionHeader, strconv.Itoa(config.Version))
+			c.JSON(http.StatusOK, data)
+			return
+		}
+
+		// The db is polled only if the subscription was dropped for lagging behind.
+		var poll <-chan time.Time
+		if events == nil {
+			poll = time.After(feedPollInterval)
+		}
+
+		select {
+		case _, open := <-events:
+			if !open {
+				events = nil
+			}
+		case <-poll:
+		case <-deadline.C:
+			if config != nil {
+				c.Header("ETag", dataETag(data))
+				c.Header(versionHeader, strconv.Itoa(config.Version))
+			}
+			c.Status(http.StatusNotModified)
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// loadConfig loads the config, it is nil if the config does not exist.
+// It replies with 500 on failure.
+func (s configServer) loadConfig(c *gin.Context, typ, name string) (*Config, bool) {
+	config, err := s.queryConfig(typ, name)
+	if err != nil {
+		replyDBError(c, "failed to load config", err)
+		return nil, false
+	}
+	return config, true
+}
+
+// queryConfig loads the config from the db, it is nil if the config does not exist.
+func (s configServer) queryConfig(typ, name string) (*Config, error) {
+	config := &Config{
+		Type: typ,
+		Name: name,
+	}
+	res := s.db.First(config)
+	switch {
+	case res.RecordNotFound():
+		return nil, nil
+	case res.Error != nil:
+		return nil, res.Error
+	}
+	return config, nil
+}
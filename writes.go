@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/betrok/test-config-server/jsonschema"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
+)
+
+// handleCreate inserts a new config with the data from the request body.
+// It replies with 409 if the config already exists.
+func (s configServer) handleCreate(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessWrite, typ, name) {
+		return
+	}
+	data, ok := readData(c)
+	if !ok || !s.checkMasked(c, typ, name, data) || !s.authorizeDependencies(c, typ, name, data) {
+		return
+	}
+
+	config := Config{
+		Type: typ,
+		Name: name,
+		Data: postgres.Jsonb{RawMessage: data},
+	}
+	err := s.writer(c).Create(&config).Error
+	if err != nil {
+		replySaveError(c, typ, name, err)
+		return
+	}
+	s.changed(typ, name)
+
+	log.Printf("config '%v' with type '%v' created", name, typ)
+	s.setVersion(c, &config)
+	c.Header("Location", configPath(typ, name))
+	s.replyData(c, http.StatusCreated, typ, name, config.Data.RawMessage)
+}
+
+// handlePut inserts a new config or replaces the data of the existing one.
+// Replacement requires a precondition(see checkPrecondition), so concurrent changes are not lost.
+func (s configServer) handlePut(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessWrite, typ, name) {
+		return
+	}
+	data, ok := readData(c)
+	if !ok || !s.checkMasked(c, typ, name, data) || !s.authorizeDependencies(c, typ, name, data) {
+		return
+	}
+
+	tx := s.writer(c).Begin()
+	config, ok := lockConfig(c, tx, typ, name)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+	created := config == nil
+	if !s.checkPrecondition(c, config, !created) {
+		tx.Rollback()
+		return
+	}
+
+	var err error
+	if created {
+		config = &Config{
+			Type: typ,
+			Name: name,
+			Data: postgres.Jsonb{RawMessage: data},
+		}
+		err = tx.Create(config).Error
+	} else {
+		config.Data = postgres.Jsonb{RawMessage: data}
+		err = tx.Save(config).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		replySaveError(c, typ, name, err)
+		return
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		replyDBError(c, "failed to commit config", err)
+		return
+	}
+	s.changed(typ, name)
+
+	s.setVersion(c, config)
+	if created {
+		log.Printf("config '%v' with type '%v' created", name, typ)
+		c.Header("Location", configPath(typ, name))
+		s.replyData(c, http.StatusCreated, typ, name, config.Data.RawMessage)
+	} else {
+		log.Printf("config '%v' with type '%v' replaced", name, typ)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// handlePatch applies the request body to the existing config as a JSON merge patch(RFC 7386):
+// the keys of the patch replace the ones of the data, nested objects are merged recursively
+// and null values remove keys. A precondition is required(see checkPrecondition).
+func (s configServer) handlePatch(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessWrite, typ, name) {
+		return
+	}
+	patch, ok := readData(c)
+	if !ok || !s.checkMasked(c, typ, name, patch) {
+		return
+	}
+
+	tx := s.writer(c).Begin()
+	config, ok := lockConfig(c, tx, typ, name)
+	if ok && config == nil {
+		replyNotFound(c, typ, name)
+		ok = false
+	}
+	if !ok || !s.checkPrecondition(c, config, true) {
+		tx.Rollback()
+		return
+	}
+
+	data, err := mergePatch(config.Data.RawMessage, patch)
+	if err != nil {
+		tx.Rollback()
+		replyDBError(c, "failed to patch config data", err)
+		return
+	}
+	if !s.authorizeDependencies(c, typ, name, data) {
+		tx.Rollback()
+		return
+	}
+
+	config.Data = postgres.Jsonb{RawMessage: data}
+	err = tx.Save(config).Error
+	if err != nil {
+		tx.Rollback()
+		replySaveError(c, typ, name, err)
+		return
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		replyDBError(c, "failed to commit config", err)
+		return
+	}
+	s.changed(typ, name)
+
+	log.Printf("config '%v' with type '%v' patched", name, typ)
+	s.setVersion(c, config)
+	c.Status(http.StatusNoContent)
+}
+
+// handleDelete removes the config, a precondition is required(see checkPrecondition).
+func (s configServer) handleDelete(c *gin.Context) {
+	typ, name, ok := configKey(c)
+	if !ok || !authorize(c, accessWrite, typ, name) {
+		return
+	}
+
+	tx := s.writer(c).Begin()
+	config, ok := lockConfig(c, tx, typ, name)
+	if ok && config == nil {
+		replyNotFound(c, typ, name)
+		ok = false
+	}
+	if !ok || !s.checkPrecondition(c, config, true) {
+		tx.Rollback()
+		return
+	}
+
+	// Both parts of the primary key are not empty here,
+	// so gorm will not delete the whole table.
+	err := tx.Delete(config).Error
+	if err != nil {
+		tx.Rollback()
+		replySaveError(c, typ, name, err)
+		return
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		replyDBError(c, "failed to commit config removal", err)
+		return
+	}
+	s.changed(typ, name)
+
+	log.Printf("config '%v' with type '%v' deleted", name, typ)
+	c.Status(http.StatusNoContent)
+}
+
+// changed propagates the committed change of the config to the cache and the change feed.
+func (s configServer) changed(typ, name string) {
+	s.cache.invalidate(typ, name)
+	s.lookups.forget(typ, name)
+	if s.snapshot != nil {
+		// The reload goes before the reply, so the client reads its own writes.
+		err := s.snapshot.reload()
+		if err != nil {
+			log.Printf("failed to reload configs snapshot: %v", err)
+		}
+	}
+	s.feed.notify()
+}
+
+// lockConfig loads the config and locks its row till the end of the transaction,
+// the config is nil if it does not exist. It replies with 500 on failure.
+func lockConfig(c *gin.Context, tx *gorm.DB, typ, name string) (*Config, bool) {
+	config := &Config{
+		Type: typ,
+		Name: name,
+	}
+	res := tx.Set("gorm:query_option", "FOR UPDATE").First(config)
+	switch {
+	case res.RecordNotFound():
+		return nil, true
+	case res.Error != nil:
+		replyDBError(c, "failed to load config", res.Error)
+		return nil, false
+	}
+	return config, true
+}
+
+// configKey returns the type and the name of the config from the path parameters.
+// It replies with 400 if any of them is empty.
+func configKey(c *gin.Context) (typ, name string, ok bool) {
+	typ, name = c.Param("type"), c.Param("name")
+	if typ == "" || name == "" {
+		log.Println("incomplite request: empty type or name")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "empty type or name",
+		})
+		return "", "", false
+	}
+	return typ, name, true
+}
+
+// configPath returns the path of the config lookup route.
+func configPath(typ, name string) string {
+	return "/configs/" + typ + "/" + name
+}
+
+// readData reads the request body and ensures that it contains a JSON object
+// without the strings which would be taken for the encrypted values(see checkPlaintext).
+// It replies with 400 otherwise.
+func readData(c *gin.Context) (json.RawMessage, bool) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Printf("failed to read request body: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "bad request",
+		})
+		return nil, false
+	}
+
+	err = checkObject(body)
+	if err == nil {
+		err = checkPlaintext(body)
+	}
+	if err != nil {
+		log.Printf("invalid config data: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	}
+
+	return json.RawMessage(body), true
+}
+
+// dataError rejects the saved data which is not a JSON object or contains the reserved strings,
+// the handlers reading the data from the request check it beforehand(see readData).
+type dataError string
+
+func (e dataError) Error() string {
+	return string(e)
+}
+
+// checkObject returns an error if data is not a JSON object.
+func checkObject(data []byte) error {
+	var obj map[string]json.RawMessage
+	// null is decoded into the nil map without error.
+	if json.Unmarshal(data, &obj) != nil || obj == nil {
+		return errors.New("data must be a JSON object")
+	}
+	return nil
+}
+
+// mergePatch applies JSON merge patch to the data, both arguments must be JSON objects.
+func mergePatch(data, patch json.RawMessage) (json.RawMessage, error) {
+	var target, changes map[string]interface{}
+	err := decodeJSON(data, &target)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeJSON(patch, &changes)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeObjects(target, changes))
+}
+
+func mergeObjects(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = map[string]interface{}{}
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			nested, _ := target[key].(map[string]interface{})
+			target[key] = mergeObjects(nested, value)
+		default:
+			target[key] = value
+		}
+	}
+	return target
+}
+
+// decodeJSON unmarshals data keeping numbers as is,
+// so they will not lose precision after the next marshaling.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// isUniqueViolation checks whether err was caused by the duplicate primary key.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func replyNotFound(c *gin.Context, typ, name string) {
+	log.Printf("config '%v' with type '%v' not found", name, typ)
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "record not found",
+	})
+}
+
+func replyConflict(c *gin.Context, typ, name string) {
+	log.Printf("config '%v' with type '%v' already exists", name, typ)
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "record already exists",
+	})
+}
+
+// replySaveError replies with the status corresponding to the error of the config saving.
+func replySaveError(c *gin.Context, typ, name string, err error) {
+	switch err := err.(type) {
+	case *jsonschema.ValidationError:
+		log.Printf("config '%v' with type '%v' rejected: %v", name, typ, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":      "data does not match the schema",
+			"violations": err.Strings(),
+		})
+	case dependentsError:
+		log.Printf("config '%v' with type '%v' rejected: %v", name, typ, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":      "configs extending the layer do not match the schema",
+			"violations": err,
+		})
+	case layerError, dataError:
+		log.Printf("config '%v' with type '%v' rejected: %v", name, typ, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+		})
+	case *refError:
+		log.Printf("config '%v' with type '%v' rejected: %v", name, typ, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":     err.msg,
+			"reference": "${" + err.ref + "}",
+		})
+	default:
+		// Creation may also fail if someone has created the same config concurrently.
+		if isUniqueViolation(err) {
+			replyConflict(c, typ, name)
+			return
+		}
+		replyDBError(c, "failed to save config", err)
+	}
+}
+
+func replyDBError(c *gin.Context, msg string, err error) {
+	log.Printf("%v: %v", msg, err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": "db error",
+	})
+}